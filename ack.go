@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"time"
+)
+
+const defaultRetries = 3
+const defaultRetryBackoff = 5 * time.Second
+
+// ackTolerance is the deviation from the target position still accepted as reached.
+const ackTolerance = 2
+
+// ackMargin is added to the expected travel time before a command is considered missed.
+var ackMargin = 10 * time.Second
+
+// trackCommand starts tracking a command sent to the output cover, a previous command not reached yet is dropped.
+// Stop commands have no target and are not tracked.
+func trackCommand(window *domain.StateWindow, command string, priority int) *domain.CommandAck {
+	clearAck(window)
+	target, ok := commandTarget(command)
+	if !ok {
+		return nil
+	}
+	targets := coverTargets(window, command, target)
+	window.Ack = &domain.CommandAck{
+		Command:  command,
+		Target:   target,
+		Targets:  targets,
+		Priority: priority,
+		Timeout:  travelTime(window, targets) + ackMargin,
+	}
+	return window.Ack
+}
+
+// coverTargets returns the position each output cover of the window is sent to by command, several covers get their
+// own commands raised by their calibration.
+func coverTargets(window *domain.StateWindow, command string, target int) []int {
+	if len(window.OutputCovers) < 2 {
+		return []int{target}
+	}
+	targets := make([]int, len(window.OutputCovers))
+	for i, c := range coverCommands(window, command) {
+		if t, ok := commandTarget(c); ok {
+			targets[i] = t
+		} else {
+			targets[i] = target
+		}
+	}
+	return targets
+}
+
+// commandTarget returns the position an output cover command moves the cover to.
+func commandTarget(command string) (int, bool) {
+	var c CoverStateAndPosition
+	if err := json.Unmarshal([]byte(command), &c); err != nil {
+		return 0, false
+	}
+	if c.Position != nil {
+		return *c.Position, true
+	}
+	if c.State != nil && *c.State == "OPEN" {
+		return 100, true
+	}
+	if c.State != nil && *c.State == "CLOSE" {
+		return 0, true
+	}
+	return 0, false
+}
+
+func clearAck(window *domain.StateWindow) {
+	if window.Ack != nil {
+		window.Ack.Stop()
+	}
+	window.Ack = nil
+}
+
+// armAck waits for the output cover to reach the target of the command once it was sent, may be called from any
+// goroutine.
+func armAck(window *domain.StateWindow, ack *domain.CommandAck) {
+	ack.Arm(ack.Timeout, func() {
+		window.Dispatch(func() {
+			ackTimeout(window, ack)
+		})
+	})
+}
+
+// travelTime estimates the time the output covers need from their current position to their targets, several covers
+// of a window finish together with the slowest one.
+func travelTime(window *domain.StateWindow, targets []int) time.Duration {
+	var travel time.Duration
+	for i, config := range window.Config.CoverOutputs() {
+		cover, target := window.OutputCover, targets[0]
+		if i < len(window.OutputCovers) {
+			cover = window.OutputCovers[i]
+		}
+		if i < len(targets) {
+			target = targets[i]
+		}
+		if t := coverTravelTime(config, getCoverPosition(cover), target); t > travel {
+			travel = t
+		}
+	}
+	return travel
+}
+
+// ackTimeout retries a command whose target was not reached in time, with a backoff doubled on each attempt. Once
+// all retries failed, the window is flagged as stuck.
+func ackTimeout(window *domain.StateWindow, ack *domain.CommandAck) {
+	if window.Ack != ack {
+		return
+	}
+	if ackReached(window, ack) {
+		confirmAck(window)
+		return
+	}
+
+	config := state.Configuration.Commands
+	retries := defaultRetries
+	if config.Retries != 0 {
+		retries = config.Retries
+	}
+	backoff := defaultRetryBackoff
+	if config.RetryBackoffMs > 0 {
+		backoff = time.Duration(config.RetryBackoffMs) * time.Millisecond
+	}
+
+	ack.Attempt++
+	if ack.Attempt > retries {
+		common.LogWarning(fmt.Sprintf("Output cover of window %s did not reach %d after %d attempts, giving up", window.Id, ack.Target, ack.Attempt))
+		clearAck(window)
+		window.Stuck.UpdateState(String("ON"))
+		return
+	}
+
+	backoff = backoff << (ack.Attempt - 1)
+	common.LogWarning(fmt.Sprintf("Output cover of window %s did not reach %d, retrying in %s (attempt %d of %d)", window.Id, ack.Target, backoff, ack.Attempt, retries))
+	ack.Arm(backoff, func() {
+		window.Dispatch(func() {
+			if window.Ack != ack {
+				return
+			}
+			// The retry must not move an open door down
+			if ack.Target < getCoverPosition(window.OutputCover) && lockedOut(window) {
+				common.LogDebug(fmt.Sprintf("Skipping retry of window %s, door is open", window.Id))
+				lockoutCover(window)
+				return
+			}
+			retryMove(window, ack)
+		})
+	})
+}
+
+// ackReached reports whether every output cover of the window is at its own target of the command.
+func ackReached(window *domain.StateWindow, ack *domain.CommandAck) bool {
+	covers := window.OutputCovers
+	if len(covers) == 0 {
+		covers = []*domain.Cover{window.OutputCover}
+	}
+	for i, cover := range covers {
+		target := ack.Target
+		if i < len(ack.Targets) {
+			target = ack.Targets[i]
+		}
+		if math.Abs(float64(getCoverPosition(cover)-target)) > ackTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAck confirms the command of the window once the output covers report their target positions.
+func checkAck(window *domain.StateWindow) {
+	if window.Ack != nil && ackReached(window, window.Ack) {
+		confirmAck(window)
+	}
+}
+
+func confirmAck(window *domain.StateWindow) {
+	common.LogDebug(fmt.Sprintf("Output cover of window %s reached %d", window.Id, window.Ack.Target))
+	clearAck(window)
+	if window.Stuck.State != nil && *window.Stuck.State == "ON" {
+		common.LogDebug(fmt.Sprintf("Output cover of window %s is reachable again", window.Id))
+		window.Stuck.UpdateState(String("OFF"))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func startAckTestState(t *testing.T) (*domain.MemoryClient, *domain.StateWindow) {
+	margin := ackMargin
+	ackMargin = 10 * time.Millisecond
+	t.Cleanup(func() { ackMargin = margin })
+
+	config := testWindowConfig("w01")
+	config.OutputCoverTimeUp = 0
+	config.OutputCoverTimeDown = 0
+	client := startTestState(t, config)
+	state.Configuration.Commands.Retries = 2
+	state.Configuration.Commands.RetryBackoffMs = 5
+	return client, state.Windows[0]
+}
+
+// waitPublished waits until n messages are published to topic and returns them.
+func waitPublished(client *domain.MemoryClient, topic string, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		published := client.PublishedTo(topic)
+		if len(published) >= n || time.Now().After(deadline) {
+			return published
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommandRetry(t *testing.T) {
+	client, window := startAckTestState(t)
+	if _, ok := client.Retained("homeassistant/binary_sensor/test/test_w_01_stuck/config"); !ok {
+		t.Errorf("no discovery config of the stuck sensor")
+	}
+
+	client.Inject(*window.ManualInputCover.CommandTopic, "50")
+	stuck := waitPublished(client, *window.Stuck.StateTopic, 1)
+	if len(stuck) != 1 || stuck[0] != "ON" {
+		t.Fatalf("stuck states %v, want ON after the retries", stuck)
+	}
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 3 {
+		t.Errorf("sent %v, want the command and 2 retries", commands)
+	}
+
+	// A command reaching its target clears the flag
+	client.Inject(*window.ManualInputCover.CommandTopic, "60")
+	waitPublished(client, *window.OutputCover.CommandTopic, 4)
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(60))
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.Stuck.State != "OFF" {
+			t.Errorf("stuck = %q once the target was reached, want OFF", *window.Stuck.State)
+		}
+	})
+}
+
+func TestCommandAcknowledged(t *testing.T) {
+	client, window := startAckTestState(t)
+
+	client.Inject(*window.ManualInputCover.CommandTopic, "50")
+	waitIdle(client)
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(49))
+	waitIdle(client)
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 1 {
+		t.Errorf("sent %v, want no retry once the cover reached its target", commands)
+	}
+	window.Sync(func() {
+		if window.Ack != nil || *window.Stuck.State != "OFF" {
+			t.Errorf("ack = %v, stuck = %q", window.Ack, *window.Stuck.State)
+		}
+	})
+}
+
+func TestCommandTarget(t *testing.T) {
+	tests := []struct {
+		command string
+		want    int
+		ok      bool
+	}{
+		{`{"position":30}`, 30, true},
+		{`{"state":"OPEN"}`, 100, true},
+		{`{"state":"STOP"}`, 0, false},
+	}
+	for _, tt := range tests {
+		if target, ok := commandTarget(tt.command); target != tt.want || ok != tt.ok {
+			t.Errorf("commandTarget(%s) = %d, %v, want %d, %v", tt.command, target, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestRetryMotorProtection retries through the motor protection, the debounce holds the retry back and the attempts
+// are counted on.
+func TestRetryMotorProtection(t *testing.T) {
+	client, window := startAckTestState(t)
+	state.Configuration.Motor.DebounceMs = 50
+
+	var ack *domain.CommandAck
+	window.Sync(func() {
+		ack = trackCommand(window, `{"position":50}`, domain.PriorityManual)
+		ackTimeout(window, ack)
+	})
+	time.Sleep(25 * time.Millisecond)
+	waitIdle(client)
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 0 {
+		t.Fatalf("sent %v within the debounce time", commands)
+	}
+
+	stuck := waitPublished(client, *window.Stuck.StateTopic, 1)
+	if len(stuck) != 1 || stuck[0] != "ON" {
+		t.Fatalf("stuck states %v, want ON after the retries", stuck)
+	}
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 2 {
+		t.Errorf("sent %v, want 2 retries", commands)
+	}
+}
+
+func TestRetryLockout(t *testing.T) {
+	client, window := startAckTestState(t)
+	window.Config.Lockout = true
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(60))
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+	client.ClearPublished()
+
+	window.Sync(func() {
+		ackTimeout(window, trackCommand(window, `{"position":20}`, domain.PriorityManual))
+	})
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 0 {
+		t.Errorf("retried %v while the door is open, want none", commands)
+	}
+	window.Sync(func() {
+		if window.Ack != nil {
+			t.Errorf("ack = %v, want dropped while the door is open", window.Ack)
+		}
+	})
+}
+
+// TestCommandAckAllCovers retries a command until every output cover of the window reached its target.
+func TestCommandAckAllCovers(t *testing.T) {
+	margin := ackMargin
+	ackMargin = 10 * time.Millisecond
+	t.Cleanup(func() { ackMargin = margin })
+	config := testMultiCoverConfig("w01", 0, 0)
+	config.OutputCoverTimeUp = 0
+	config.OutputCoverTimeDown = 0
+	client := startTestState(t, config)
+	state.Configuration.Commands.Retries = 2
+	state.Configuration.Commands.RetryBackoffMs = 5
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(50))
+	client.Inject(config.OutputCovers[0].StateTopic, *coverPayload(50))
+	waitIdle(client)
+
+	client.Inject(*window.ManualInputCover.CommandTopic, "80")
+	waitIdle(client)
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(80))
+
+	stuck := waitPublished(client, *window.Stuck.StateTopic, 1)
+	if len(stuck) != 1 || stuck[0] != "ON" {
+		t.Fatalf("stuck states %v, want ON while the second cover missed its target", stuck)
+	}
+	if commands := client.PublishedTo(window.Config.OutputCovers[0].StateTopic + "/set"); len(commands) != 3 {
+		t.Errorf("sent %v to the second cover, want the command and 2 retries", commands)
+	}
+}
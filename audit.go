@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+)
+
+const defaultAuditSize = 20
+const defaultAuditMaxSizeKb = 1024
+const defaultAuditMaxFiles = 3
+
+var auditFile *common.RotatingFile
+
+func initAudit() {
+	cfg := state.Configuration.Audit
+	if cfg.File == "" {
+		return
+	}
+	maxSize := cfg.MaxSizeKb
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSizeKb
+	}
+	maxFiles := cfg.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultAuditMaxFiles
+	}
+	auditFile = &common.RotatingFile{
+		Name:     cfg.File,
+		MaxSize:  int64(maxSize) * 1024,
+		MaxFiles: maxFiles,
+	}
+	common.LogDebug(fmt.Sprintf("Writing decision audit trail to %s", cfg.File))
+}
+
+func closeAudit() {
+	if auditFile != nil {
+		auditFile.Close()
+	}
+}
+
+func auditSize() int {
+	if state.Configuration.Audit.Size > 0 {
+		return state.Configuration.Audit.Size
+	}
+	return defaultAuditSize
+}
+
+// recordDecision stores the decision in the window's ring buffer, publishes the buffer as JSON attributes of the
+// automation output sensor and appends it to the audit file, if configured.
+func recordDecision(window *domain.StateWindow, decision domain.Decision) {
+	window.Decisions.Add(decision)
+
+	if window.OutputValue.JsonAttributesTopic != nil {
+		attributes := struct {
+			Decisions []domain.Decision `json:"decisions"`
+		}{window.Decisions.Entries()}
+		j, _ := json.Marshal(attributes)
+		token := window.OutputValue.AppState.Mqtt.Publish(*window.OutputValue.JsonAttributesTopic, common.QoS, false, string(j))
+		token.Wait()
+	}
+
+	if auditFile != nil {
+		j, _ := json.Marshal(decision)
+		if _, err := auditFile.Write(append(j, '\n')); err != nil {
+			common.LogWarning(fmt.Sprintf("Unable to write audit trail: %s", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"testing"
+)
+
+func TestRecordDecisionWritesAuditFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	auditFile = &common.RotatingFile{Name: name, MaxSize: 1024 * 1024, MaxFiles: 1}
+	t.Cleanup(func() {
+		closeAudit()
+		auditFile = nil
+	})
+	window := &domain.StateWindow{Id: "w01", Decisions: domain.NewDecisionLog(1), OutputValue: &domain.Sensor{}}
+
+	recordDecision(window, domain.Decision{Window: "w01", Chosen: 40, Command: `{"position": 40}`})
+	recordDecision(window, domain.Decision{Window: "w01", Chosen: 40, Skipped: "equal position"})
+
+	if entries := window.Decisions.Entries(); len(entries) != 1 || entries[0].Skipped != "equal position" {
+		t.Errorf("decisions = %+v, want the latest only", entries)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var decisions []domain.Decision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d domain.Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatalf("audit line %q: %s", scanner.Text(), err)
+		}
+		decisions = append(decisions, d)
+	}
+	if len(decisions) != 2 || decisions[0].Command == "" || decisions[1].Skipped == "" {
+		t.Errorf("audit file = %+v, want both decisions", decisions)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func subscribeHomeassistantStatus() {
+	topic := domain.GetHomeassistantStatusTopic(state.Configuration)
+	t := state.Mqtt.Subscribe(topic, 0, homeassistantStatusHandler)
+	t.Wait()
+	if t.Error() != nil {
+		common.LogError(fmt.Sprintf("Unable to subscribe to Homeassistant status %s", topic), t.Error())
+	}
+}
+
+// homeassistantStatusHandler republishes everything when Homeassistant comes online. A retained birth message is
+// ignored, Homeassistant was online before and got everything on startup.
+var homeassistantStatusHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	if msg.Retained() || string(msg.Payload()) != "online" {
+		return
+	}
+	common.LogDebug("Homeassistant is online, republishing discovery, availability and states")
+	republish()
+}
+
+// republish queues the discovery messages and states of all entities, the availability is retained and published
+// right away.
+func republish() {
+	entities := state.DiscoveryEntities()
+	for _, e := range entities {
+		domain.RepublishDiscovery(e)
+	}
+	makeAvailable()
+	common.LogDebug(fmt.Sprintf("Republishing %d entities", len(entities)))
+}
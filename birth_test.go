@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHomeassistantBirthRepublishes(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	statusTopic := "homeassistant/status"
+
+	client.Inject(*window.ManualInputCover.CommandTopic, "40")
+	waitIdle(client)
+
+	// A retained birth message, received on subscribe, is ignored
+	client.Unsubscribe(statusTopic)
+	client.Publish(statusTopic, 0, true, "online")
+	client.ClearPublished()
+	subscribeHomeassistantStatus()
+	waitIdle(client)
+	if n := len(client.Published()); n != 0 {
+		t.Fatalf("retained birth message published %d messages", n)
+	}
+
+	client.Inject(statusTopic, "offline")
+	client.Inject(statusTopic, "online")
+	waitIdle(client)
+
+	for _, topic := range state.DiscoveryTopics() {
+		if n := len(client.PublishedTo(topic)); n != 1 {
+			t.Errorf("discovery %s republished %d times, want 1", topic, n)
+		}
+	}
+	if states := client.PublishedTo("shutter_control/test/availability"); len(states) != 1 || states[0] != "online" {
+		t.Errorf("availability = %v, want [online]", states)
+	}
+	if states := client.PublishedTo(*window.Automation.StateTopic); len(states) != 1 || states[0] != "ON" {
+		t.Errorf("automation state = %v, want [ON]", states)
+	}
+	if n := len(client.PublishedTo(window.Config.OutputCoverStateTopic)); n != 0 {
+		t.Errorf("published %d states to the output cover", n)
+	}
+
+	// The echo of the republished automation state must not reset the manual value
+	window.Sync(func() {
+		if *window.ManualValue.State != "40" {
+			t.Errorf("manual value = %q after republish, want 40", *window.ManualValue.State)
+		}
+	})
+}
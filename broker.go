@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"shutter_control/common"
+	"shutter_control/domain"
+
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// EmbeddedBroker is the value of `mqtt` in the configuration to run the embedded broker.
+const EmbeddedBroker = "embedded"
+const defaultEmbeddedListen = ":1883"
+
+// startEmbeddedBroker starts the embedded MQTT broker if configured and points the configuration to it. Returns nil
+// if an external broker is used.
+func startEmbeddedBroker(config *domain.CtrlConfig) *mqttserver.Server {
+	if config.MqttHost != EmbeddedBroker {
+		return nil
+	}
+	listen := embeddedListen(config)
+
+	server := mqttserver.New(&mqttserver.Options{
+		InlineClient: false,
+		Logger:       slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+	err := server.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		common.LogError("Unable to configure embedded broker", err)
+	}
+	err = server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: listen}))
+	if err != nil {
+		common.LogError(fmt.Sprintf("Unable to listen on %s", listen), err)
+	}
+	err = server.Serve()
+	if err != nil {
+		common.LogError("Unable to start embedded broker", err)
+	}
+
+	config.MqttHost = embeddedBrokerAddress(listen)
+	common.LogDebug(fmt.Sprintf("Embedded broker listening on %s", listen))
+	return server
+}
+
+func stopEmbeddedBroker(server *mqttserver.Server) {
+	if server != nil {
+		server.Close()
+	}
+}
+
+func embeddedListen(config *domain.CtrlConfig) string {
+	if config.EmbeddedListen == "" {
+		return defaultEmbeddedListen
+	}
+	return config.EmbeddedListen
+}
+
+// embeddedBrokerAddress returns the address to connect to a broker listening on listen.
+func embeddedBrokerAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "tcp://" + listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "tcp://" + net.JoinHostPort(host, port)
+}
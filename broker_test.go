@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"shutter_control/domain"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestEmbeddedBrokerAddress(t *testing.T) {
+	tests := map[string]string{
+		":1883":          "tcp://127.0.0.1:1883",
+		"0.0.0.0:1884":   "tcp://127.0.0.1:1884",
+		"10.0.0.2:1883":  "tcp://10.0.0.2:1883",
+		"localhost:1883": "tcp://localhost:1883",
+	}
+	for listen, want := range tests {
+		if got := embeddedBrokerAddress(listen); got != want {
+			t.Errorf("embeddedBrokerAddress(%q) = %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func freeListenAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestEmbeddedBroker runs the whole application against the embedded broker, with a second client acting as
+// window sensor and output cover.
+func TestEmbeddedBroker(t *testing.T) {
+	newTestState()
+	config := *state.Configuration
+	config.MqttHost = EmbeddedBroker
+	config.EmbeddedListen = freeListenAddress(t)
+	config.Windows = []domain.CtrlConfigWindow{testWindowConfig("w01")}
+
+	broker := startEmbeddedBroker(&config)
+	defer stopEmbeddedBroker(broker)
+
+	client := connect(config)
+	defer disconnect(client)
+	state.Mqtt = client
+	state.Configuration = &config
+	initEntities()
+	defer func() {
+		for _, w := range state.Windows {
+			w.Stop()
+		}
+	}()
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(config.MqttHost)
+	options.SetClientID("device")
+	device := mqtt.NewClient(options)
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+
+	window := state.Windows[0]
+	commands := make(chan string, 10)
+	device.Subscribe(*window.OutputCover.CommandTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		commands <- string(msg.Payload())
+	}).Wait()
+	device.Publish(window.Config.OutputCoverStateTopic, 0, false, *coverPayload(10)).Wait()
+	device.Publish(window.Config.WindowSensorStateTopic, 0, false, *contactPayload(true)).Wait()
+	device.Publish(*window.ScheduledInputCover.CommandTopic, 0, false, `{"position": 40}`).Wait()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case command := <-commands:
+			if command == `{"position":40}` {
+				return
+			}
+		case <-timeout:
+			t.Fatal("scheduled position not commanded through the embedded broker")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const controlTimeout = 5 * time.Second
+
+// controlClientCommand returns a subcommand sending the command to the control topic of a running instance and
+// printing its reply.
+func controlClientCommand(command string) func(args []string) error {
+	return func(args []string) error {
+		common.LogState.Debug = false
+		config := loadConfig()
+		if config.MqttHost == EmbeddedBroker {
+			config.MqttHost = embeddedBrokerAddress(embeddedListen(&config))
+		}
+
+		id := strconv.FormatInt(time.Now().UnixNano(), 36)
+		client, err := newClient(config, config.NodeId+"_cli_"+id)
+		if err != nil {
+			return err
+		}
+		defer disconnect(client)
+
+		reply, err := requestControl(client, &config, domain.ControlRequest{Id: id, Command: command, Args: args})
+		if err != nil {
+			return err
+		}
+		printControlReply(reply)
+		return nil
+	}
+}
+
+// requestControl sends the request and waits for the matching reply of the running instance.
+func requestControl(client domain.MqttClient, config *domain.CtrlConfig, request domain.ControlRequest) (domain.ControlReply, error) {
+	replies := make(chan domain.ControlReply, 1)
+	replyTopic := domain.GetControlReplyTopic(config)
+	t := client.Subscribe(replyTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		var reply domain.ControlReply
+		if json.Unmarshal(msg.Payload(), &reply) == nil && reply.Id == request.Id {
+			select {
+			case replies <- reply:
+			default:
+			}
+		}
+	})
+	if t.Wait() && t.Error() != nil {
+		return domain.ControlReply{}, t.Error()
+	}
+	defer client.Unsubscribe(replyTopic)
+
+	j, _ := json.Marshal(request)
+	t = client.Publish(domain.GetControlTopic(config), 0, false, j)
+	if t.Wait() && t.Error() != nil {
+		return domain.ControlReply{}, t.Error()
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Error != "" {
+			return reply, fmt.Errorf("%s", reply.Error)
+		}
+		return reply, nil
+	case <-time.After(controlTimeout):
+		return domain.ControlReply{}, fmt.Errorf("no reply from %s within %s, is it running?", config.NodeId, controlTimeout)
+	}
+}
+
+func printControlReply(reply domain.ControlReply) {
+	if reply.Message != "" {
+		fmt.Println(reply.Message)
+	}
+	if reply.Windows == nil {
+		return
+	}
+	fmt.Printf("rain: %s, automation: %s, vacation: %s\n\n", reply.Rain, reply.Automation, reply.Vacation)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WINDOW\tAUTOMATION\tSCHEDULED\tSHADING\tVACATION\tHEAT\tINSULATION\tWINDOW STATE\tWINDOW OPEN\tRAIN\tMANUAL\tOUTPUT\tPOSITION\tTILT\tCALIBRATING")
+	for _, s := range reply.Windows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.Id, s.Automation, s.Scheduled,
+			s.Shading, s.Vacation, s.Heat, s.Insulation, s.WindowState, s.WindowOpen, s.Rain, s.Manual, s.Output, s.Position,
+			s.Tilt, s.Calibrating)
+	}
+	w.Flush()
+}
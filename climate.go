@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultComfortLimit = 25.0
+const defaultHeatPosition = 20
+const defaultInsulationBelow = 5.0
+
+var climateTick = 1 * time.Minute
+
+var climate = struct {
+	mu      sync.Mutex
+	outdoor *float64
+	done    chan struct{}
+}{}
+
+func heatEnabled() bool {
+	return state.Heat != nil && state.Heat.GetState() == "ON"
+}
+
+func insulationEnabled() bool {
+	return state.Insulation != nil && state.Insulation.GetState() == "ON"
+}
+
+// subscribeTemperatures subscribes the temperature sensors of the rooms and outside. Windows of the same room share
+// the subscription of its sensor.
+func subscribeTemperatures() {
+	rooms := make(map[string][]*domain.StateWindow)
+	for _, w := range state.Windows {
+		if w.Config.TemperatureSensor != "" {
+			rooms[w.Config.TemperatureSensor] = append(rooms[w.Config.TemperatureSensor], w)
+		}
+	}
+	for topic, windows := range rooms {
+		subscribeSensor(topic, roomTemperatureHandler(windows))
+	}
+	if topic := state.Configuration.Climate.OutdoorSensor; topic != "" {
+		subscribeSensor(topic, outdoorTemperatureHandler)
+	}
+}
+
+func subscribeSensor(topic string, handler mqtt.MessageHandler) {
+	t := state.Mqtt.Subscribe(topic, 0, handler)
+	t.Wait()
+	if t.Error() != nil {
+		common.LogError(fmt.Sprintf("Unable to subscribe to sensor %s", topic), t.Error())
+	}
+}
+
+func roomTemperatureHandler(windows []*domain.StateWindow) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		temperature, ok := parseTemperature(string(msg.Payload()))
+		if !ok {
+			common.LogWarning(fmt.Sprintf("Ignoring temperature %s of %s", string(msg.Payload()), msg.Topic()))
+			return
+		}
+		for _, w := range windows {
+			window := w
+			window.Dispatch(func() {
+				window.RoomTemperature = &temperature
+				updateClimate(window, time.Now())
+			})
+		}
+	}
+}
+
+var outdoorTemperatureHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	temperature, ok := parseTemperature(string(msg.Payload()))
+	if !ok {
+		common.LogWarning(fmt.Sprintf("Ignoring outdoor temperature %s", string(msg.Payload())))
+		return
+	}
+	climate.mu.Lock()
+	climate.outdoor = &temperature
+	climate.mu.Unlock()
+	updateClimateAll(time.Now())
+}
+
+// parseTemperature accepts a plain number or the payload of a zigbee2mqtt sensor, {"temperature": 21.5}.
+func parseTemperature(payload string) (float64, bool) {
+	if strings.HasPrefix(payload, "{") {
+		var s struct {
+			Temperature *float64 `json:"temperature"`
+		}
+		if err := json.Unmarshal([]byte(payload), &s); err != nil || s.Temperature == nil {
+			return 0, false
+		}
+		return *s.Temperature, true
+	}
+	t, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	return t, err == nil
+}
+
+func outdoorTemperature() *float64 {
+	climate.mu.Lock()
+	defer climate.mu.Unlock()
+	return climate.outdoor
+}
+
+// startClimate updates the climate and shading layers periodically as the sun moves.
+func startClimate() {
+	if state.Configuration.Location.Latitude == nil || state.Configuration.Location.Longitude == nil {
+		common.LogWarning("No location configured, heat protection ignores the sun and winter insulation is off")
+	}
+	climate.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(climateTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				updateClimateAll(now)
+			case <-done:
+				return
+			}
+		}
+	}(climate.done)
+}
+
+func stopClimate() {
+	if climate.done != nil {
+		close(climate.done)
+		climate.done = nil
+	}
+}
+
+func updateClimateAll(now time.Time) {
+	for _, w := range state.Windows {
+		window := w
+		window.Dispatch(func() {
+			updateClimate(window, now)
+		})
+	}
+}
+
+// updateClimate recalculates the window once its heat protection, winter insulation or shading changed.
+func updateClimate(window *domain.StateWindow, now time.Time) {
+	changed := calculateClimateValue(window, now)
+	if calculateShadingValue(window, now) || changed {
+		calculateWindowValue(window)
+		recalculateWindow(window)
+	}
+}
+
+// calculateClimateValue updates the heat protection and winter insulation layers of the window and returns whether
+// one of them changed.
+func calculateClimateValue(window *domain.StateWindow, now time.Time) bool {
+	config := state.Configuration.Climate
+
+	heat := ""
+	comfortLimit := defaultComfortLimit
+	if config.ComfortLimit != nil {
+		comfortLimit = *config.ComfortLimit
+	}
+	if heatEnabled() && window.RoomTemperature != nil && *window.RoomTemperature > comfortLimit && sunOnWindow(window, now) {
+		position := defaultHeatPosition
+		if config.HeatPosition != nil {
+			position = *config.HeatPosition
+		}
+		heat = strconv.Itoa(position)
+	}
+
+	insulation := ""
+	insulationBelow := defaultInsulationBelow
+	if config.InsulationBelow != nil {
+		insulationBelow = *config.InsulationBelow
+	}
+	temperature := outdoorTemperature()
+	if temperature == nil {
+		temperature = window.RoomTemperature
+	}
+	if insulationEnabled() && temperature != nil && *temperature < insulationBelow && night(now) {
+		insulation = strconv.Itoa(config.InsulationPosition)
+	}
+
+	changed := false
+	if *window.HeatValue.State != heat {
+		common.LogDebug(fmt.Sprintf("Heat protection of window %s=%s", window.Id, heat))
+		window.HeatValue.UpdateState(&heat)
+		changed = true
+	}
+	if *window.InsulationValue.State != insulation {
+		common.LogDebug(fmt.Sprintf("Winter insulation of window %s=%s", window.Id, insulation))
+		window.InsulationValue.UpdateState(&insulation)
+		changed = true
+	}
+	return changed
+}
+
+// sunPosition returns the azimuth and elevation of the sun, false without a location.
+func sunPosition(now time.Time) (float64, float64, bool) {
+	location := state.Configuration.Location
+	if location.Latitude == nil || location.Longitude == nil {
+		return 0, 0, false
+	}
+	azimuth, elevation := domain.SunPosition(now, *location.Latitude, *location.Longitude)
+	return azimuth, elevation, true
+}
+
+// sunOnWindow reports whether the sun shines on the facade of the window. Without a location the sun is assumed to
+// shine, without a facade any sun above the horizon counts.
+func sunOnWindow(window *domain.StateWindow, now time.Time) bool {
+	azimuth, elevation, ok := sunPosition(now)
+	if !ok {
+		return true
+	}
+	if window.Config.Facade == nil {
+		return elevation > 0
+	}
+	return domain.SunOnFacade(azimuth, elevation, *window.Config.Facade)
+}
+
+func night(now time.Time) bool {
+	_, elevation, ok := sunPosition(now)
+	return ok && elevation < 0
+}
+
+// basePosition returns the scheduled position, lowered by the shading, heat protection or winter insulation.
+func basePosition(window *domain.StateWindow) int {
+	position, e := strconv.Atoi(scheduledValue(window))
+	if e != nil {
+		position = 0
+	}
+	for _, layer := range []*domain.Sensor{window.ShadingValue, window.HeatValue, window.InsulationValue} {
+		if v, e := strconv.Atoi(*layer.State); e == nil && v < position {
+			position = v
+		}
+	}
+	return position
+}
+
+// heatSwitch turns the heat protection of all windows on or off.
+var heatSwitch mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	value := string(msg.Payload())
+	changed := state.Heat.GetState() != value
+	state.Heat.UpdateState(&value)
+	if changed {
+		common.LogDebug(fmt.Sprintf("Heat protection %s, recalculating all windows", value))
+		recalculateAll()
+	}
+}
+
+// insulationSwitch turns the winter insulation of all windows on or off.
+var insulationSwitch mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	value := string(msg.Payload())
+	changed := state.Insulation.GetState() != value
+	state.Insulation.UpdateState(&value)
+	if changed {
+		common.LogDebug(fmt.Sprintf("Winter insulation %s, recalculating all windows", value))
+		recalculateAll()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func climateTestConfig(id string) domain.CtrlConfigWindow {
+	config := testWindowConfig(id)
+	config.TemperatureSensor = "zigbee2mqtt/room_living"
+	return config
+}
+
+func TestParseTemperature(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    float64
+		wantOk  bool
+	}{
+		{"21.5", 21.5, true},
+		{" -3 ", -3, true},
+		{`{"temperature": 26.2, "humidity": 40}`, 26.2, true},
+		{`{"humidity": 40}`, 0, false},
+		{"warm", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTemperature(tt.payload)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("parseTemperature(%q) = %v, %t, want %v, %t", tt.payload, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestHeatProtection(t *testing.T) {
+	client := startTestState(t, climateTestConfig("w01"), climateTestConfig("w02"))
+	for _, w := range state.Windows {
+		client.Inject(*w.ScheduledInputCover.CommandTopic, `{"position": 100}`)
+	}
+	client.Inject(*state.Heat.CommandTopic, "ON")
+	client.Inject("zigbee2mqtt/room_living", `{"temperature": 27}`)
+	waitIdle(client)
+
+	for _, w := range state.Windows {
+		window := w
+		window.Sync(func() {
+			if *window.HeatValue.State != "20" {
+				t.Errorf("heat value of %s = %q above the comfort limit, want 20", window.Id, *window.HeatValue.State)
+			}
+			if *window.OutputValue.State != "20" {
+				t.Errorf("output of %s = %q with heat protection, want 20", window.Id, *window.OutputValue.State)
+			}
+		})
+	}
+
+	// An open window still raises the cover
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OutputValue.State == "20" {
+			t.Errorf("output = %q with the window open, want it raised", *window.OutputValue.State)
+		}
+	})
+
+	client.Inject("zigbee2mqtt/room_living", "24")
+	waitIdle(client)
+	window = state.Windows[1]
+	window.Sync(func() {
+		if *window.HeatValue.State != "" {
+			t.Errorf("heat value = %q below the comfort limit, want none", *window.HeatValue.State)
+		}
+	})
+}
+
+func TestHeatProtectionOff(t *testing.T) {
+	client := startTestState(t, climateTestConfig("w01"))
+	client.Inject("zigbee2mqtt/room_living", "30")
+	waitIdle(client)
+	window := state.Windows[0]
+	window.Sync(func() {
+		if *window.HeatValue.State != "" {
+			t.Errorf("heat value = %q with the switch off, want none", *window.HeatValue.State)
+		}
+	})
+}
+
+func TestHeatProtectionFacade(t *testing.T) {
+	config := climateTestConfig("w01")
+	newTestState(config)
+	state.Configuration.Location = domain.CtrlConfigLocation{Latitude: Float(52.52), Longitude: Float(13.405)}
+	state.Heat.State = String("ON")
+	window := state.Windows[0]
+	temperature := 28.0
+	window.RoomTemperature = &temperature
+	noon := time.Date(2024, 6, 21, 11, 7, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		facade float64
+		time   time.Time
+		want   string
+	}{
+		{"south at noon", 180, noon, "20"},
+		{"north at noon", 0, noon, ""},
+		{"south at night", 180, noon.Add(12 * time.Hour), ""},
+	}
+	for _, tt := range tests {
+		facade := tt.facade
+		window.Config.Facade = &facade
+		calculateClimateValue(window, tt.time)
+		if *window.HeatValue.State != tt.want {
+			t.Errorf("%s: heat value = %q, want %q", tt.name, *window.HeatValue.State, tt.want)
+		}
+	}
+}
+
+func TestWinterInsulation(t *testing.T) {
+	newTestState(climateTestConfig("w01"))
+	state.Configuration.Location = domain.CtrlConfigLocation{Latitude: Float(52.52), Longitude: Float(13.405)}
+	state.Insulation.State = String("ON")
+	window := state.Windows[0]
+	room := 20.0
+	window.RoomTemperature = &room
+	night := time.Date(2024, 12, 21, 23, 0, 0, 0, time.UTC)
+	day := time.Date(2024, 12, 21, 11, 0, 0, 0, time.UTC)
+
+	// Without an outdoor sensor the room temperature counts
+	calculateClimateValue(window, night)
+	if *window.InsulationValue.State != "" {
+		t.Errorf("insulation value = %q in a warm room, want none", *window.InsulationValue.State)
+	}
+
+	cold := -2.0
+	climate.outdoor = &cold
+	t.Cleanup(func() { climate.outdoor = nil })
+	calculateClimateValue(window, night)
+	if *window.InsulationValue.State != "0" {
+		t.Errorf("insulation value = %q on a cold night, want 0", *window.InsulationValue.State)
+	}
+	if position := basePosition(window); position != 0 {
+		t.Errorf("base position = %d on a cold night, want 0", position)
+	}
+	calculateClimateValue(window, day)
+	if *window.InsulationValue.State != "" {
+		t.Errorf("insulation value = %q during the day, want none", *window.InsulationValue.State)
+	}
+}
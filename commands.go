@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands are the subcommands selected by the first positional argument.
+var commands = map[string]func(args []string) error{
+	"replay":     replayCommand,
+	"status":     controlClientCommand("status"),
+	"set":        controlClientCommand("set"),
+	"automation": controlClientCommand("automation"),
+	"rain":       controlClientCommand("rain"),
+	"calibrate":  controlClientCommand("calibrate"),
+	"discovery":  controlClientCommand("discovery"),
+}
+
+func runCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %s, available commands: %s", args[0], strings.Join(names, ", "))
+	}
+	return command(args[1:])
+}
@@ -14,11 +14,10 @@ type LogLevels struct {
 }
 
 var (
-	Retain           bool          = false
-	QoS              byte          = 0
-	HADiscoveryDelay time.Duration = 500 * time.Millisecond
-	MachineID        string
-	LogState         = LogLevels{
+	Retain    bool = false
+	QoS       byte = 0
+	MachineID string
+	LogState  = LogLevels{
 		Debug:    true,
 		Error:    true,
 		Warn:     true,
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append-only file which is rotated to name.1, name.2, ... once it exceeds MaxSize bytes.
+type RotatingFile struct {
+	Name     string
+	MaxSize  int64
+	MaxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size+int64(len(p)) > r.MaxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	if r.MaxFiles > 0 {
+		for i := r.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.Name, i), fmt.Sprintf("%s.%d", r.Name, i+1))
+		}
+		os.Rename(r.Name, r.Name+".1")
+		os.Remove(fmt.Sprintf("%s.%d", r.Name, r.MaxFiles+1))
+	} else {
+		os.Remove(r.Name)
+	}
+	return r.open()
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	r := &RotatingFile{Name: name, MaxSize: 10, MaxFiles: 2}
+	defer r.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, want := range map[string]string{name: "fourth\n", name + ".1": "third\n", name + ".2": "second\n"} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), content, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than %d rotated files", r.MaxFiles)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(name, []byte("existing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &RotatingFile{Name: name, MaxSize: 1024}
+	if _, err := r.Write([]byte("appended\n")); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	content, _ := os.ReadFile(name)
+	if string(content) != "existing\nappended\n" {
+		t.Errorf("content = %q, want the existing content kept", content)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// controlCommands are executed on requests of the command line tool, see cli.go.
+var controlCommands = map[string]func(args []string) (domain.ControlReply, error){
+	"status":     controlStatus,
+	"set":        controlSet,
+	"automation": controlAutomation,
+	"rain":       controlRain,
+	"calibrate":  controlCalibrate,
+	"discovery":  controlDiscovery,
+}
+
+func subscribeControl() {
+	topic := domain.GetControlTopic(state.Configuration)
+	t := state.Mqtt.Subscribe(topic, 0, controlHandler)
+	t.Wait()
+	if t.Error() != nil {
+		common.LogError(fmt.Sprintf("Unable to subscribe to control topic %s", topic), t.Error())
+	}
+}
+
+var controlHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	var request domain.ControlRequest
+	var reply domain.ControlReply
+	err := json.Unmarshal(msg.Payload(), &request)
+	if err == nil {
+		common.LogDebug(fmt.Sprintf("Control command %s %s", request.Command, strings.Join(request.Args, " ")))
+		command, ok := controlCommands[request.Command]
+		if ok {
+			reply, err = command(request.Args)
+		} else {
+			err = fmt.Errorf("unknown command %s", request.Command)
+		}
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Id = request.Id
+
+	j, _ := json.Marshal(reply)
+	token := state.Mqtt.Publish(domain.GetControlReplyTopic(state.Configuration), 0, false, j)
+	token.Wait()
+}
+
+func controlWindow(id string) (*domain.StateWindow, error) {
+	for _, w := range state.Windows {
+		if w.Id == id {
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown window %s", id)
+}
+
+func controlArgs(args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func controlStatus(args []string) (domain.ControlReply, error) {
+	reply := domain.ControlReply{
+		Rain:       state.RainInput.GetState(),
+		Automation: state.Automation.GetState(),
+		Vacation:   state.Vacation.GetState(),
+		Windows:    make([]domain.WindowStatus, 0),
+	}
+	for _, w := range state.Windows {
+		window := w
+		window.Sync(func() {
+			status := domain.WindowStatus{
+				Id:          window.Id,
+				Automation:  *window.Automation.State,
+				Scheduled:   *window.ScheduledValue.State,
+				Shading:     *window.ShadingValue.State,
+				Vacation:    *window.VacationValue.State,
+				Heat:        *window.HeatValue.State,
+				Insulation:  *window.InsulationValue.State,
+				WindowState: *window.WindowOpenState.State,
+				WindowOpen:  *window.WindowOpenValue.State,
+				Rain:        *window.RainValue.State,
+				Manual:      *window.ManualValue.State,
+				Output:      *window.OutputValue.State,
+				Position:    getWindowPosition(window),
+				Calibrating: *window.Calibrating.State,
+			}
+			if window.OutputTiltValue != nil {
+				status.Tilt = *window.OutputTiltValue.State
+			}
+			reply.Windows = append(reply.Windows, status)
+		})
+	}
+	return reply, nil
+}
+
+func controlSet(args []string) (domain.ControlReply, error) {
+	if err := controlArgs(args, 2, "set <window> <position|OPEN|CLOSE|STOP>"); err != nil {
+		return domain.ControlReply{}, err
+	}
+	window, err := controlWindow(args[0])
+	if err != nil {
+		return domain.ControlReply{}, err
+	}
+	value := strings.ToUpper(args[1])
+	if value != "OPEN" && value != "CLOSE" && value != "STOP" {
+		p, err := strconv.Atoi(value)
+		if err != nil || p < 0 || p > 100 {
+			return domain.ControlReply{}, fmt.Errorf("invalid position %s, expected 0-100, OPEN, CLOSE or STOP", args[1])
+		}
+	}
+	window.Dispatch(func() {
+		manualCoverCommand(window, value)
+	})
+	return domain.ControlReply{Message: fmt.Sprintf("window %s set to %s", window.Id, value)}, nil
+}
+
+func controlAutomation(args []string) (domain.ControlReply, error) {
+	if err := controlArgs(args, 2, "automation <window> on|off"); err != nil {
+		return domain.ControlReply{}, err
+	}
+	window, err := controlWindow(args[0])
+	if err != nil {
+		return domain.ControlReply{}, err
+	}
+	value := strings.ToUpper(args[1])
+	if value != "ON" && value != "OFF" {
+		return domain.ControlReply{}, fmt.Errorf("invalid automation state %s, expected on or off", args[1])
+	}
+	window.Dispatch(func() {
+		window.Automation.UpdateState(&value)
+	})
+	return domain.ControlReply{Message: fmt.Sprintf("automation of window %s turned %s", window.Id, strings.ToLower(value))}, nil
+}
+
+func controlRain(args []string) (domain.ControlReply, error) {
+	if err := controlArgs(args, 1, "rain "+strings.Join(*state.RainInput.Options, "|")); err != nil {
+		return domain.ControlReply{}, err
+	}
+	for _, o := range *state.RainInput.Options {
+		if o == args[0] {
+			rainCommand(args[0])
+			return domain.ControlReply{Message: fmt.Sprintf("rain set to %s", args[0])}, nil
+		}
+	}
+	return domain.ControlReply{}, fmt.Errorf("invalid rain level %s, expected one of %s", args[0], strings.Join(*state.RainInput.Options, ", "))
+}
+
+func controlCalibrate(args []string) (domain.ControlReply, error) {
+	if err := controlArgs(args, 1, "calibrate <window>"); err != nil {
+		return domain.ControlReply{}, err
+	}
+	window, err := controlWindow(args[0])
+	if err != nil {
+		return domain.ControlReply{}, err
+	}
+	window.Dispatch(func() {
+		calibrateCommand(window)
+	})
+	return domain.ControlReply{Message: fmt.Sprintf("calibrating window %s", window.Id)}, nil
+}
+
+// controlDiscovery removes the discovery messages of all entities from Homeassistant. They are published again on the
+// next start.
+func controlDiscovery(args []string) (domain.ControlReply, error) {
+	if len(args) != 1 || args[0] != "purge" {
+		return domain.ControlReply{}, fmt.Errorf("usage: discovery purge")
+	}
+	topics := state.DiscoveryTopics()
+	purgeDiscovery(topics)
+	return domain.ControlReply{Message: fmt.Sprintf("purged %d discovery topics", len(topics))}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+)
+
+func control(t *testing.T, client *domain.MemoryClient, command string, args ...string) (domain.ControlReply, error) {
+	t.Helper()
+	reply, err := requestControl(client, state.Configuration, domain.ControlRequest{Id: command, Command: command, Args: args})
+	waitIdle(client)
+	return reply, err
+}
+
+func TestControlStatus(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"), testWindowConfig("w02"))
+	client.Inject(*state.RainInput.CommandTopic, domain.RainDrizzle)
+	waitIdle(client)
+
+	reply, err := control(t, client, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rain != domain.RainDrizzle {
+		t.Errorf("rain = %q, want %q", reply.Rain, domain.RainDrizzle)
+	}
+	if len(reply.Windows) != 2 || reply.Windows[0].Id != "w01" || reply.Windows[1].Id != "w02" {
+		t.Fatalf("windows = %+v", reply.Windows)
+	}
+	if reply.Windows[0].Automation != "ON" || reply.Windows[0].Calibrating != "0" {
+		t.Errorf("window status = %+v", reply.Windows[0])
+	}
+}
+
+func TestControlStatusClimate(t *testing.T) {
+	client := startTestState(t, climateTestConfig("w01"))
+	client.Inject(*state.Heat.CommandTopic, "ON")
+	client.Inject("zigbee2mqtt/room_living", `{"temperature": 27}`)
+	waitIdle(client)
+
+	reply, err := control(t, client, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Windows) != 1 || reply.Windows[0].Heat != "20" || reply.Windows[0].Insulation != "" {
+		t.Errorf("windows = %+v, want heat 20 and no insulation", reply.Windows)
+	}
+}
+
+func TestControlStatusShading(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Tilt = true
+	config.IlluminanceSensor = "zigbee2mqtt/lux_south"
+	config.ShadingPosition = Int(40)
+	client := startTestState(t, config)
+	state.Configuration.Shading.EnterDelaySeconds = Int(0)
+	window := state.Windows[0]
+	t.Cleanup(func() { window.Sync(func() { stopShadingTimer(window) }) })
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 100}`)
+	client.Inject(*window.ScheduledInputCover.TiltCommandTopic, "30")
+	client.Inject("zigbee2mqtt/lux_south", `{"illuminance_lux": 60000}`)
+	waitIdle(client)
+
+	reply, err := control(t, client, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Windows) != 1 || reply.Windows[0].Shading != "40" || reply.Windows[0].Tilt != "30" {
+		t.Errorf("windows = %+v, want shading 40 and tilt 30", reply.Windows)
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	waitIdle(client)
+
+	if _, err := control(t, client, "set", "w01", "40"); err != nil {
+		t.Fatal(err)
+	}
+	if command := lastCommand(client, window); command != `{"position":40}` {
+		t.Errorf("set command = %q", command)
+	}
+
+	if _, err := control(t, client, "automation", "w01", "off"); err != nil {
+		t.Fatal(err)
+	}
+	window.Sync(func() {
+		if *window.Automation.State != "OFF" {
+			t.Errorf("automation = %q, want OFF", *window.Automation.State)
+		}
+	})
+
+	if _, err := control(t, client, "rain", domain.RainStorm); err != nil {
+		t.Fatal(err)
+	}
+	if rain := state.RainInput.GetState(); rain != domain.RainStorm {
+		t.Errorf("rain = %q, want %q", rain, domain.RainStorm)
+	}
+
+	if _, err := control(t, client, "calibrate", "w01"); err != nil {
+		t.Fatal(err)
+	}
+	if command := lastCommand(client, window); command != `{"state":"OPEN"}` {
+		t.Errorf("calibrate command = %q", command)
+	}
+	window.Sync(func() {
+		if *window.Calibrating.State != "1" {
+			t.Errorf("calibrating = %q, want 1", *window.Calibrating.State)
+		}
+	})
+}
+
+func TestControlDiscoveryPurge(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	topics := state.DiscoveryTopics()
+	if len(topics) == 0 {
+		t.Fatal("no discovery topics recorded")
+	}
+
+	if _, err := control(t, client, "discovery", "purge"); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range topics {
+		if p, ok := client.Retained(topic); ok {
+			t.Errorf("discovery topic %s still retained: %s", topic, p)
+		}
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	tests := []struct {
+		command string
+		args    []string
+	}{
+		{"unknown", nil},
+		{"set", []string{"w99", "40"}},
+		{"set", []string{"w01", "140"}},
+		{"set", []string{"w01"}},
+		{"automation", []string{"w01", "maybe"}},
+		{"rain", []string{"hail"}},
+		{"discovery", []string{"list"}},
+	}
+	for _, tt := range tests {
+		if _, err := control(t, client, tt.command, tt.args...); err == nil {
+			t.Errorf("%s %v succeeded, want error", tt.command, tt.args)
+		}
+	}
+	if commands := client.PublishedTo(*state.Windows[0].OutputCover.CommandTopic); len(commands) != 0 {
+		t.Errorf("invalid commands moved the cover: %v", commands)
+	}
+}
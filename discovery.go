@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"time"
+)
+
+const defaultDiscoveryInterval = 20 * time.Millisecond
+const defaultDiscoveryStateDelay = 1 * time.Second
+
+// initDiscovery starts the queue publishing the discovery messages in the background, entities are live before
+// Homeassistant knows them.
+func initDiscovery() {
+	interval := defaultDiscoveryInterval
+	if state.Configuration.Discovery.IntervalMs > 0 {
+		interval = time.Duration(state.Configuration.Discovery.IntervalMs) * time.Millisecond
+	}
+	stateDelay := defaultDiscoveryStateDelay
+	if state.Configuration.Discovery.StateDelayMs > 0 {
+		stateDelay = time.Duration(state.Configuration.Discovery.StateDelayMs) * time.Millisecond
+	}
+	state.Discovery = domain.NewDiscoveryQueue(interval, stateDelay)
+	state.Discovery.Start()
+}
+
+func stopDiscovery() {
+	if state.Discovery != nil {
+		state.Discovery.Stop()
+	}
+}
+
+// discoveryTopicsState is the key of the discovery topics published by the last run in the persisted states.
+const discoveryTopicsState = "discovery_topics"
+
+// cleanupDiscovery removes the discovery messages of entities published by a previous run which no longer exist, e.g.
+// of a window removed from the configuration. Must be called once all entities are subscribed.
+func cleanupDiscovery() {
+	current := make(map[string]bool)
+	for _, t := range state.DiscoveryTopics() {
+		current[t] = true
+	}
+
+	stale := make([]string, 0)
+	for _, t := range persistedDiscoveryTopics() {
+		if !current[t] {
+			stale = append(stale, t)
+		}
+	}
+	if len(stale) > 0 {
+		common.LogDebug(fmt.Sprintf("Removing %d stale discovery topics: %v", len(stale), stale))
+		purgeDiscovery(stale)
+	}
+	persistDiscoveryTopics()
+}
+
+func persistedDiscoveryTopics() []string {
+	topics := make([]string, 0)
+	if val, ok := state.GetState(discoveryTopicsState); ok {
+		if err := json.Unmarshal([]byte(val), &topics); err != nil {
+			common.LogWarning(fmt.Sprintf("Unable to read persisted discovery topics: %s", err.Error()))
+		}
+	}
+	return topics
+}
+
+func persistDiscoveryTopics() {
+	j, _ := json.Marshal(state.DiscoveryTopics())
+	state.SetState(discoveryTopicsState, string(j))
+}
+
+// purgeDiscovery publishes empty retained messages, Homeassistant removes the entities and the broker the retained
+// discovery messages.
+func purgeDiscovery(topics []string) {
+	for _, t := range topics {
+		token := state.Mqtt.Publish(t, 0, true, "")
+		token.Wait()
+	}
+}
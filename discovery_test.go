@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"shutter_control/domain"
+	"testing"
+)
+
+func TestCleanupDiscovery(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"), testWindowConfig("w02"))
+	cleanupDiscovery()
+	previous := persistedDiscoveryTopics()
+	if len(previous) == 0 {
+		t.Fatal("no discovery topics persisted")
+	}
+
+	// Restart with w02 removed from the configuration, keeping the retained messages and the persisted states
+	for _, w := range state.Windows {
+		w.Stop()
+	}
+	states := state.CopyStates()
+	newTestState()
+	state.Mqtt = client
+	state.States = states
+	state.Configuration.Windows = []domain.CtrlConfigWindow{testWindowConfig("w01")}
+	initEntities()
+	waitIdle(client)
+	cleanupDiscovery()
+	waitIdle(client)
+
+	current := make(map[string]bool)
+	for _, topic := range state.DiscoveryTopics() {
+		current[topic] = true
+	}
+	removed := 0
+	for _, topic := range previous {
+		_, retained := client.Retained(topic)
+		if current[topic] && !retained {
+			t.Errorf("discovery topic %s of a configured entity was removed", topic)
+		}
+		if !current[topic] {
+			removed++
+			if retained {
+				t.Errorf("stale discovery topic %s still retained", topic)
+			}
+		}
+	}
+	if removed == 0 {
+		t.Error("no discovery topics of w02 were removed")
+	}
+
+	var persisted []string
+	val, _ := state.GetState(discoveryTopicsState)
+	json.Unmarshal([]byte(val), &persisted)
+	if len(persisted) != len(current) {
+		t.Errorf("persisted %d discovery topics, want %d", len(persisted), len(current))
+	}
+}
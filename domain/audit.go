@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// Decision records the inputs and the outcome of a single recalculation of a window.
+type Decision struct {
+	Time        time.Time `json:"time"`
+	Window      string    `json:"window"`
+	Automation  string    `json:"automation"`
+	Suspended   bool      `json:"suspended,omitempty"`
+	Scheduled   string    `json:"scheduled"`
+	Vacation    string    `json:"vacation,omitempty"`
+	Shading     string    `json:"shading,omitempty"`
+	Heat        string    `json:"heat,omitempty"`
+	Insulation  string    `json:"insulation,omitempty"`
+	WindowOpen  string    `json:"window_open"`
+	Rain        string    `json:"rain"`
+	Manual      string    `json:"manual"`
+	Current     int       `json:"current"`
+	Positions   []int     `json:"positions,omitempty"`
+	Chosen      int       `json:"chosen"`
+	Tilt        string    `json:"tilt,omitempty"`
+	Calibration bool      `json:"calibration,omitempty"`
+	Skipped     string    `json:"skipped,omitempty"`
+	Command     string    `json:"command,omitempty"`
+}
+
+// DecisionLog is a bounded ring buffer holding the most recent decisions of a window.
+type DecisionLog struct {
+	mu      sync.Mutex
+	entries []Decision
+	next    int
+	full    bool
+}
+
+func NewDecisionLog(size int) *DecisionLog {
+	if size < 1 {
+		size = 1
+	}
+	return &DecisionLog{entries: make([]Decision, size)}
+}
+
+func (l *DecisionLog) Add(d Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = d
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Entries returns the recorded decisions, oldest first.
+func (l *DecisionLog) Entries() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]Decision{}, l.entries[:l.next]...)
+	}
+	return append(append([]Decision{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
@@ -0,0 +1,22 @@
+package domain
+
+import "testing"
+
+func TestDecisionLogIsBounded(t *testing.T) {
+	l := NewDecisionLog(3)
+	if n := len(l.Entries()); n != 0 {
+		t.Fatalf("new log has %d entries", n)
+	}
+	for i := 0; i < 5; i++ {
+		l.Add(Decision{Chosen: i})
+	}
+	entries := l.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("log has %d entries, want 3", len(entries))
+	}
+	for i, want := range []int{2, 3, 4} {
+		if entries[i].Chosen != want {
+			t.Errorf("entries[%d].Chosen = %d, want %d", i, entries[i].Chosen, want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/iancoleman/strcase"
 	"log"
 	"shutter_control/common"
+	"time"
 )
 
 // see https://github.com/W-Floyd/ha-mqtt-iot/blob/main/devices/externaldevice/binary_sensor.go
@@ -39,6 +40,14 @@ type BinarySensor struct {
 	State                  *string                                `json:"-"`
 	StateUpdatedFunc       *func(*BinarySensor, *string, *string) `json:"-"`
 	Window                 *StateWindow                           `json:"-"`
+	Debounce               time.Duration                          `json:"-"`
+	MaxDebounce            time.Duration                          `json:"-"`
+	Immediate              func(string) bool                      `json:"-"`
+	LastSeen               time.Time                              `json:"-"`
+	echo                   echoFilter
+	debounceTimer          *time.Timer
+	debounceSeq            int
+	debounceSince          time.Time
 }
 
 func (d *BinarySensor) GetRawId() string {
@@ -54,12 +63,12 @@ func (d *BinarySensor) UpdateState(state *string) {
 	}
 
 	common.LogDebug(fmt.Sprintf("Set BinarySensor state %s=%s", *d.UniqueId, *d.State))
-	token := (*d.AppState.Mqtt).Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
+	token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
 	token.Wait()
 }
 
 func (d *BinarySensor) Subscribe() {
-	c := *d.AppState.Mqtt
+	c := d.AppState.Mqtt
 
 	if d.StateTopic != nil {
 		t := c.Subscribe(*d.StateTopic, 0, d.handleStateUpdate())
@@ -67,6 +76,10 @@ func (d *BinarySensor) Subscribe() {
 		if t.Error() != nil {
 			log.Fatal(t.Error())
 		}
+		// Only the sensors of the shutter control itself are published to Homeassistant, not the contact sensors
+		if ownTopic(d, *d.StateTopic) {
+			PublishDiscovery(d)
+		}
 	}
 }
 
@@ -74,23 +87,77 @@ func (d *BinarySensor) handleStateUpdate() func(client mqtt.Client, msg mqtt.Mes
 
 	return func(client mqtt.Client, msg mqtt.Message) {
 		newState := string(msg.Payload())
-		oldState := d.State
+		d.Window.Dispatch(func() {
+			if d.echo.consume(newState) {
+				return
+			}
+			d.LastSeen = time.Now()
+			if d.Debounce > 0 && (d.Immediate == nil || !d.Immediate(newState)) {
+				d.debounce(newState)
+				return
+			}
+			d.cancelDebounce()
+			d.applyState(newState)
+		})
+	}
+
+}
 
-		if oldState == nil || newState != *oldState {
-			d.State = &newState
-			common.LogDebug(fmt.Sprintf("BinarySensor state %s=%s", *d.UniqueId, *d.State))
+// debounce applies a state once no other state arrived for Debounce, states in between are dropped. A sensor flapping
+// for longer than MaxDebounce gets its latest state applied nevertheless. Runs on the event loop of the window.
+func (d *BinarySensor) debounce(newState string) {
+	now := time.Now()
+	if d.debounceSince.IsZero() {
+		d.debounceSince = now
+	}
+	delay := d.Debounce
+	if d.MaxDebounce > 0 {
+		if left := d.debounceSince.Add(d.MaxDebounce).Sub(now); left < delay {
+			delay = max(left, 0)
 		}
+	}
 
-		d.AppState.States[*d.UniqueId] = newState
+	d.debounceSeq++
+	seq := d.debounceSeq
+	if d.debounceTimer != nil {
+		d.debounceTimer.Stop()
+	}
+	d.debounceTimer = time.AfterFunc(delay, func() {
+		d.Window.Dispatch(func() {
+			if d.debounceSeq == seq {
+				d.debounceSince = time.Time{}
+				d.applyState(newState)
+			}
+		})
+	})
+}
 
-		if d.StateUpdatedFunc != nil {
-			(*d.StateUpdatedFunc)(d, oldState, &newState)
-		}
+// cancelDebounce drops the state held back, e.g. when a state to be applied right away arrives.
+func (d *BinarySensor) cancelDebounce() {
+	if d.debounceTimer != nil {
+		d.debounceTimer.Stop()
 	}
+	d.debounceSeq++
+	d.debounceSince = time.Time{}
+}
+
+func (d *BinarySensor) applyState(newState string) {
+	oldState := d.State
 
+	if oldState == nil || newState != *oldState {
+		d.State = &newState
+		common.LogDebug(fmt.Sprintf("BinarySensor state %s=%s", *d.UniqueId, *d.State))
+	}
+
+	d.AppState.SetState(*d.UniqueId, newState)
+
+	if d.StateUpdatedFunc != nil {
+		(*d.StateUpdatedFunc)(d, oldState, &newState)
+	}
 }
+
 func (d *BinarySensor) UnSubscribe() {
-	c := *d.AppState.Mqtt
+	c := d.AppState.Mqtt
 	if d.StateTopic != nil {
 		t := c.Unsubscribe(*d.StateTopic)
 		t.Wait()
@@ -110,7 +177,7 @@ func (d *BinarySensor) Initialize() {
 
 	}
 	d.PopulateTopics()
-	if val, ok := d.AppState.States[*d.UniqueId]; ok {
+	if val, ok := d.AppState.GetState(*d.UniqueId); ok {
 		d.State = new(string)
 		*d.State = val
 	}
@@ -133,3 +200,16 @@ func (d *BinarySensor) GetAppState() *State {
 func (d *BinarySensor) SetAppState(appState *State) {
 	d.AppState = appState
 }
+
+func (d *BinarySensor) GetWindow() *StateWindow {
+	return d.Window
+}
+
+// PublishState publishes the current state again, unless the state topic belongs to a contact sensor.
+func (d *BinarySensor) PublishState() {
+	if d.StateTopic != nil && d.State != nil && ownTopic(d, *d.StateTopic) {
+		d.echo.expect(*d.State)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
+		token.Wait()
+	}
+}
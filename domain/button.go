@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"fmt"
+	"log"
+	"shutter_control/common"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	strcase "github.com/iancoleman/strcase"
+)
+
+// see https://www.home-assistant.io/integrations/button.mqtt/
+
+type Button struct {
+	AvailabilityMode       *string             `json:"availability_mode,omitempty"`     // "When `availability` is configured, this controls the conditions needed to set the entity to `available`. Valid entries are `all`, `any`, and `latest`."
+	AvailabilityTemplate   *string             `json:"availability_template,omitempty"` // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) to extract device's availability from the `availability_topic`."
+	AvailabilityTopic      *string             `json:"availability_topic,omitempty"`    // "The MQTT topic subscribed to receive availability (online/offline) updates. Must not be used together with `availability`."
+	CommandTemplate        *string             `json:"command_template,omitempty"`      // "Defines a [template](/docs/configuration/templating/#using-command-templates-with-mqtt) to generate the payload to send to `command_topic`."
+	CommandTopic           *string             `json:"command_topic,omitempty"`         // "The MQTT topic to publish commands to trigger the button."
+	CommandFunc            mqtt.MessageHandler `json:"-"`
+	Device                 *Device             `json:"device,omitempty"`
+	DeviceClass            *string             `json:"device_class,omitempty"`             // "The [type/class](/integrations/button/#device-class) of the button to set the icon in the frontend."
+	EnabledByDefault       *bool               `json:"enabled_by_default,omitempty"`       // "Flag which defines if the entity should be enabled when first added."
+	Encoding               *string             `json:"encoding,omitempty"`                 // "The encoding of the published messages."
+	EntityCategory         *string             `json:"entity_category,omitempty"`          // "The [category](https://developers.home-assistant.io/docs/core/entity#generic-properties) of the entity."
+	Icon                   *string             `json:"icon,omitempty"`                     // "[Icon](/docs/configuration/customizing-devices/#icon) for the entity."
+	JsonAttributesTemplate *string             `json:"json_attributes_template,omitempty"` // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) to extract the JSON dictionary from messages received on the `json_attributes_topic`."
+	JsonAttributesTopic    *string             `json:"json_attributes_topic,omitempty"`    // "The MQTT topic subscribed to receive a JSON dictionary payload and then set as button attributes."
+	Name                   *string             `json:"name,omitempty"`                     // "The name to use when displaying this button."
+	ObjectId               *string             `json:"object_id,omitempty"`                // "Used instead of `name` for automatic generation of `entity_id`"
+	PayloadAvailable       *string             `json:"payload_available,omitempty"`        // "The payload that represents the available state."
+	PayloadNotAvailable    *string             `json:"payload_not_available,omitempty"`    // "The payload that represents the unavailable state."
+	PayloadPress           *string             `json:"payload_press,omitempty"`            // "The payload To send to trigger the button."
+	Qos                    *int                `json:"qos,omitempty"`                      // "The maximum QoS level to be used when receiving and publishing messages."
+	Retain                 *bool               `json:"retain,omitempty"`                   // "If the published message should have the retain flag on or not."
+	UniqueId               *string             `json:"unique_id,omitempty"`                // "An ID that uniquely identifies this button entity. If two buttons have the same unique ID, Home Assistant will raise an exception."
+	AppState               *State              `json:"-"`
+	Window                 *StateWindow        `json:"-"`
+}
+
+func (d *Button) GetRawId() string {
+	return "button"
+}
+
+func (d *Button) GetUniqueId() string {
+	return *d.UniqueId
+}
+
+// UpdateState does nothing, buttons are stateless.
+func (d *Button) UpdateState(state *string) {
+}
+
+func (d *Button) Subscribe() {
+	c := d.AppState.Mqtt
+	if d.Window != nil {
+		d.AppState.RegisterTopic(*d.CommandTopic, d.Window)
+	}
+	t := c.Subscribe(*d.CommandTopic, 0, d.handlePress())
+	t.Wait()
+	if t.Error() != nil {
+		log.Fatal(t.Error())
+	}
+
+	PublishDiscovery(d)
+}
+
+// handlePress calls CommandFunc for the press payload only.
+func (d *Button) handlePress() func(client mqtt.Client, msg mqtt.Message) {
+
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) != *d.PayloadPress {
+			common.LogWarning(fmt.Sprintf("Ignoring button payload %s for %s", msg.Payload(), *d.UniqueId))
+			return
+		}
+		if d.CommandFunc != nil {
+			d.CommandFunc(client, msg)
+		}
+	}
+}
+
+func (d *Button) UnSubscribe() {
+	c := d.AppState.Mqtt
+	t := c.Unsubscribe(*d.CommandTopic)
+	t.Wait()
+	if t.Error() != nil {
+		log.Fatal(t.Error())
+	}
+}
+
+func (d *Button) Initialize() {
+	if d.Qos == nil {
+		d.Qos = new(int)
+		*d.Qos = int(common.QoS)
+	}
+	if d.Retain == nil {
+		d.Retain = new(bool)
+		*d.Retain = common.Retain
+	}
+	if d.PayloadPress == nil {
+		d.PayloadPress = new(string)
+		*d.PayloadPress = "PRESS"
+	}
+	if d.UniqueId == nil {
+		d.UniqueId = new(string)
+		*d.UniqueId = d.AppState.Configuration.NodeId + "_" + strcase.ToSnake(*d.Name)
+	}
+	d.PopulateTopics()
+}
+
+func (d *Button) PopulateTopics() {
+
+	d.AvailabilityTopic = new(string)
+	*d.AvailabilityTopic = GetAvailabilityTopic(d.AppState.Configuration)
+
+	d.CommandTopic = new(string)
+	*d.CommandTopic = GetTopic(d, "command_topic")
+}
+
+func (d *Button) GetAppState() *State {
+	return d.AppState
+}
+
+func (d *Button) SetAppState(appState *State) {
+	d.AppState = appState
+}
+
+func (d *Button) GetWindow() *StateWindow {
+	return d.Window
+}
+
+// PublishState does nothing, buttons are stateless.
+func (d *Button) PublishState() {
+}
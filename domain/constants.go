@@ -4,6 +4,18 @@ var Manufacturer = "@home"
 var SoftwareName = "Shutter Control"
 var InstanceName = "shutter_control"
 var WindowName = "Smart Window"
+var SimulationName = "Simulation"
+var GroupName = "Window Group"
+
+var EntityCategoryDiagnostic = "diagnostic"
+var EntityCategoryConfig = "config"
+var UnitPercent = "%"
+var StateClassMeasurement = "measurement"
+
+// ValueTemplatePosition hands layers without a value, empty or a negative sentinel, to Homeassistant as unknown, so
+// they are neither rejected as non-numeric nor recorded in the statistics.
+var ValueTemplatePosition = "{{ value if value | int(-1) >= 0 else 'None' }}"
+var DeviceClassEnum = "enum"
 
 var RainNone = "none"
 var RainDrizzle = "drizzle"
@@ -0,0 +1,38 @@
+package domain
+
+// ControlRequest is sent by the command line tool to the control topic of a running instance.
+type ControlRequest struct {
+	Id      string   `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlReply is published to the control reply topic, Id matches the request.
+type ControlReply struct {
+	Id         string         `json:"id"`
+	Error      string         `json:"error,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Rain       string         `json:"rain,omitempty"`
+	Automation string         `json:"automation,omitempty"`
+	Vacation   string         `json:"vacation,omitempty"`
+	Windows    []WindowStatus `json:"windows,omitempty"`
+}
+
+// WindowStatus holds the layered values of a window.
+type WindowStatus struct {
+	Id          string `json:"id"`
+	Automation  string `json:"automation"`
+	Scheduled   string `json:"scheduled"`
+	Shading     string `json:"shading"`
+	Vacation    string `json:"vacation"`
+	Heat        string `json:"heat"`
+	Insulation  string `json:"insulation"`
+	WindowState string `json:"window_state"`
+	WindowOpen  string `json:"window_open"`
+	Rain        string `json:"rain"`
+	Manual      string `json:"manual"`
+	Output      string `json:"output"`
+	Position    int    `json:"position"`
+	Tilt        string `json:"tilt"`
+	Calibrating string `json:"calibrating"`
+}
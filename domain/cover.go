@@ -8,7 +8,7 @@ import (
 	"log"
 	"shutter_control/common"
 	"strings"
-	"time"
+	"sync"
 )
 
 // see https://github.com/W-Floyd/ha-mqtt-iot/blob/main/devices/externaldevice/cover.go
@@ -19,6 +19,7 @@ type Cover struct {
 	AvailabilityTopic      *string                         `json:"availability_topic,omitempty"`    // "The MQTT topic subscribed to to receive birth and LWT messages from the MQTT cover device. If an `availability` topic is not defined, the cover availability state will always be `available`. If an `availability` topic is defined, the cover availability state will be `unavailable` by default. Must not be used together with `availability`."
 	CommandTopic           *string                         `json:"command_topic,omitempty"`         // "The MQTT topic to publish commands to control the cover."
 	CommandFunc            mqtt.MessageHandler             `json:"-"`
+	TiltCommandFunc        mqtt.MessageHandler             `json:"-"`
 	Device                 *Device                         `json:"device,omitempty"`
 	DeviceClass            *string                         `json:"device_class,omitempty"`             // "Sets the [class of the device](/integrations/cover/), changing the device state and icon that is displayed on the frontend."
 	EnabledByDefault       *bool                           `json:"enabled_by_default,omitempty"`       // "Flag which defines if the entity should be enabled when first added."
@@ -63,7 +64,9 @@ type Cover struct {
 	AppState               *State                          `json:"-"`
 	State                  *string                         `json:"-"`
 	StateUpdatedFunc       *func(*Cover, *string, *string) `json:"-"`
-	Window                 *StateWindow                    `json:"-"`
+	echo                   echoFilter
+	Window                 *StateWindow `json:"-"`
+	mu                     sync.RWMutex
 }
 
 type CoverState struct {
@@ -71,6 +74,7 @@ type CoverState struct {
 	Position        *int    `json:"position"`
 	State           *string `json:"state"`
 	Moving          *string `json:"moving"`
+	Tilt            *int    `json:"tilt,omitempty"`
 }
 
 func (d *Cover) GetRawId() string {
@@ -83,20 +87,35 @@ func (d *Cover) GetUniqueId() string {
 func (d *Cover) WriteCommand(state *string) {
 	common.LogDebug(fmt.Sprintf("Writer cover command %s=%s", *d.UniqueId, *state))
 
-	token := (*d.AppState.Mqtt).Publish(*d.CommandTopic, byte(*d.Qos), *d.Retain, *state)
+	token := d.AppState.Mqtt.Publish(*d.CommandTopic, byte(*d.Qos), *d.Retain, *state)
 	token.Wait()
 }
 func (d *Cover) UpdateState(state *string) {
+	d.mu.Lock()
 	if state != nil {
 		d.setState(state)
 		common.LogDebug(fmt.Sprintf("Set cover state %s=%s", *d.UniqueId, *d.State))
 	}
+	current := *d.State
+	d.mu.Unlock()
+
 	if d.StateTopic != nil {
-		token := (*d.AppState.Mqtt).Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, *d.State)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, current)
 		token.Wait()
 	}
 }
 
+// GetState returns the current state. Covers of a group are updated by all of its windows, so their state is
+// guarded by a lock.
+func (d *Cover) GetState() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.State == nil {
+		return ""
+	}
+	return *d.State
+}
+
 func (d *Cover) setState(state *string) {
 	var so CoverState
 	json.Unmarshal([]byte(*d.State), &so)
@@ -117,6 +136,9 @@ func (d *Cover) setState(state *string) {
 		if no.Moving != nil {
 			so.Moving = no.Moving
 		}
+		if no.Tilt != nil {
+			so.Tilt = no.Tilt
+		}
 	} else {
 		so.State = state
 	}
@@ -126,25 +148,29 @@ func (d *Cover) setState(state *string) {
 }
 
 func (d *Cover) Subscribe() {
-	c := *d.AppState.Mqtt
-	message, err := json.Marshal(d)
-	if err != nil {
-		log.Fatal(err)
-	}
+	c := d.AppState.Mqtt
 	if d.CommandFunc != nil {
+		if d.Window != nil {
+			d.AppState.RegisterTopic(*d.CommandTopic, d.Window)
+		}
 		t := c.Subscribe(*d.CommandTopic, 0, d.CommandFunc)
 		t.Wait()
 		if t.Error() != nil {
 			log.Fatal(t.Error())
 		}
 
-		if d.Window != nil {
-			d.AppState.Topics[*d.CommandTopic] = d.Window
+		if d.TiltCommandFunc != nil {
+			if d.Window != nil {
+				d.AppState.RegisterTopic(*d.TiltCommandTopic, d.Window)
+			}
+			t := c.Subscribe(*d.TiltCommandTopic, 0, d.TiltCommandFunc)
+			t.Wait()
+			if t.Error() != nil {
+				log.Fatal(t.Error())
+			}
 		}
 
-		token := c.Publish(GetDiscoveryTopic(d), 0, true, message)
-		token.Wait()
-		time.Sleep(common.HADiscoveryDelay)
+		PublishDiscovery(d)
 		d.UpdateState(nil)
 	}
 	if d.StateTopic != nil {
@@ -160,24 +186,32 @@ func (d *Cover) handleStateUpdate() func(client mqtt.Client, msg mqtt.Message) {
 
 	return func(client mqtt.Client, msg mqtt.Message) {
 		newState := string(msg.Payload())
-		oldState := d.State
-
-		if newState != *oldState {
-			d.setState(&newState)
-			common.LogDebug(fmt.Sprintf("Cover state %s=%s", *d.UniqueId, *d.State))
-		}
-
-		d.AppState.States[*d.UniqueId] = newState
-
-		if d.StateUpdatedFunc != nil {
-			(*d.StateUpdatedFunc)(d, oldState, d.State)
-		}
+		d.Window.Dispatch(func() {
+			if d.echo.consume(newState) {
+				return
+			}
+			d.mu.Lock()
+			oldState := d.State
+
+			if newState != *oldState {
+				d.setState(&newState)
+				common.LogDebug(fmt.Sprintf("Cover state %s=%s", *d.UniqueId, *d.State))
+			}
+			currentState := d.State
+			d.mu.Unlock()
+
+			d.AppState.SetState(*d.UniqueId, newState)
+
+			if d.StateUpdatedFunc != nil {
+				(*d.StateUpdatedFunc)(d, oldState, currentState)
+			}
+		})
 	}
 
 }
 
 func (d *Cover) UnSubscribe() {
-	c := *d.AppState.Mqtt
+	c := d.AppState.Mqtt
 	if d.CommandTopic != nil {
 		t := c.Unsubscribe(*d.CommandTopic)
 		t.Wait()
@@ -185,6 +219,13 @@ func (d *Cover) UnSubscribe() {
 			log.Fatal(t.Error())
 		}
 	}
+	if d.TiltCommandFunc != nil && d.TiltCommandTopic != nil {
+		t := c.Unsubscribe(*d.TiltCommandTopic)
+		t.Wait()
+		if t.Error() != nil {
+			log.Fatal(t.Error())
+		}
+	}
 	if d.StateTopic != nil {
 		t := c.Unsubscribe(*d.StateTopic)
 		t.Wait()
@@ -221,7 +262,7 @@ func (d *Cover) Initialize(allowPositioning bool) {
 	}
 	d.PopulateTopics(allowPositioning)
 
-	if val, ok := d.AppState.States[*d.UniqueId]; ok {
+	if val, ok := d.AppState.GetState(*d.UniqueId); ok {
 		d.State = new(string)
 		*d.State = val
 	}
@@ -271,6 +312,21 @@ func (d *Cover) PopulateTopics(allowPositioning bool) {
 			*d.ValueTemplate = "{{ value_json.state }}"
 		}
 	}
+
+	// Covers of venetian blinds also control the tilt of the slats
+	if d.TiltCommandFunc != nil {
+		d.TiltCommandTopic = new(string)
+		*d.TiltCommandTopic = GetTopic(d, "tilt_command_topic")
+
+		if d.TiltStatusTopic == nil && d.StateTopic != nil {
+			d.TiltStatusTopic = new(string)
+			*d.TiltStatusTopic = *d.StateTopic
+		}
+		if d.TiltStatusTemplate == nil {
+			d.TiltStatusTemplate = new(string)
+			*d.TiltStatusTemplate = "{{ value_json.tilt }}"
+		}
+	}
 }
 
 func (d *Cover) GetAppState() *State {
@@ -280,3 +336,17 @@ func (d *Cover) GetAppState() *State {
 func (d *Cover) SetAppState(appState *State) {
 	d.AppState = appState
 }
+
+func (d *Cover) GetWindow() *StateWindow {
+	return d.Window
+}
+
+// PublishState publishes the current state again, unless the state topic belongs to the output cover.
+func (d *Cover) PublishState() {
+	current := d.GetState()
+	if d.StateTopic != nil && current != "" && ownTopic(d, *d.StateTopic) {
+		d.echo.expect(current)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, current)
+		token.Wait()
+	}
+}
@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// DiscoveryQueue publishes discovery messages in the background, at most one per Interval. StateDelay after the
+// discovery message of an entity its state is published, once Homeassistant had the time to subscribe to it. Entities
+// queued multiple times are published once.
+type DiscoveryQueue struct {
+	Interval   time.Duration
+	StateDelay time.Duration
+	mu         sync.Mutex
+	pending    []Entity
+	queued     map[Entity]bool
+	wake       chan struct{}
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+func NewDiscoveryQueue(interval time.Duration, stateDelay time.Duration) *DiscoveryQueue {
+	return &DiscoveryQueue{
+		Interval:   interval,
+		StateDelay: stateDelay,
+		queued:     make(map[Entity]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (q *DiscoveryQueue) Start() {
+	q.done = make(chan struct{})
+	q.stopped = make(chan struct{})
+	go q.run()
+}
+
+// Stop ends publishing, entities still queued are dropped.
+func (q *DiscoveryQueue) Stop() {
+	if q.done != nil {
+		close(q.done)
+		<-q.stopped
+	}
+}
+
+func (q *DiscoveryQueue) Add(d Entity) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[d] {
+		return
+	}
+	q.queued[d] = true
+	q.pending = append(q.pending, d)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of entities waiting to be published.
+func (q *DiscoveryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *DiscoveryQueue) next() Entity {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	d := q.pending[0]
+	q.pending = q.pending[1:]
+	delete(q.queued, d)
+	return d
+}
+
+func (q *DiscoveryQueue) run() {
+	defer close(q.stopped)
+	for {
+		d := q.next()
+		if d == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		publishDiscovery(d)
+		time.AfterFunc(q.StateDelay, func() {
+			select {
+			case <-q.done:
+			default:
+				d.GetWindow().Dispatch(d.PublishState)
+			}
+		})
+
+		select {
+		case <-time.After(q.Interval):
+		case <-q.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDiscoveryQueue(t *testing.T) {
+	client := NewMemoryClient()
+	state := &State{
+		Mqtt:          client,
+		Configuration: &CtrlConfig{NodeId: "test", ChannelPrefix: "shutter_control", DiscoverChannel: "homeassistant"},
+		Topics:        make(map[string]*StateWindow),
+		States:        make(map[string]string),
+		Discovery:     NewDiscoveryQueue(50*time.Millisecond, 0),
+	}
+	switches := make([]*Switch, 0)
+	for _, n := range []string{"a", "b", "c"} {
+		name := n
+		s := &Switch{Name: &name, AppState: state, CommandFunc: func(_ mqtt.Client, _ mqtt.Message) {}}
+		s.Initialize()
+		switches = append(switches, s)
+	}
+
+	start := time.Now()
+	for _, s := range switches {
+		// Subscribe queues the discovery message, queuing it again is a duplicate
+		s.Subscribe()
+		PublishDiscovery(s)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("subscribing blocked for %s", elapsed)
+	}
+	if n := state.Discovery.Len(); n != 3 {
+		t.Errorf("queued %d entities, want 3 as duplicates are dropped", n)
+	}
+	if len(state.DiscoveryTopics()) != 3 {
+		t.Errorf("registered %d discovery topics, want 3", len(state.DiscoveryTopics()))
+	}
+
+	state.Discovery.Start()
+	defer state.Discovery.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for state.Discovery.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	client.Flush()
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("published 3 discovery messages within %s, want rate limiting", elapsed)
+	}
+	for _, s := range switches {
+		if n := len(client.PublishedTo(GetDiscoveryTopic(s))); n != 1 {
+			t.Errorf("discovery of %s published %d times, want 1", *s.Name, n)
+		}
+		// Published on subscribe and after the discovery message
+		if n := len(client.PublishedTo(*s.StateTopic)); n != 2 {
+			t.Errorf("state of %s published %d times, want 2", *s.Name, n)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package domain
+
+import "sync"
+
+// echoFilter recognizes the echo of a state published again by PublishState. Entities are subscribed to their own
+// state topics, without the filter republishing a state would run the state handlers once more.
+type echoFilter struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func (f *echoFilter) expect(payload string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		f.pending = make(map[string]int)
+	}
+	f.pending[payload]++
+}
+
+// consume reports whether the payload is an expected echo.
+func (f *echoFilter) consume(payload string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending[payload] == 0 {
+		return false
+	}
+	f.pending[payload]--
+	return true
+}
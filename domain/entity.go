@@ -4,8 +4,10 @@ type Entity interface {
 	GetRawId() string
 	GetUniqueId() string
 	UpdateState(state *string)
+	PublishState()
 	Subscribe()
 	UnSubscribe()
 	GetAppState() *State
 	SetAppState(appState *State)
+	GetWindow() *StateWindow
 }
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"encoding/json"
+	"log"
 	"strings"
 )
 
@@ -29,3 +31,54 @@ func GetTopic(d Entity, rawTopicString string) string {
 func GetAvailabilityTopic(cfg *CtrlConfig) string {
 	return cfg.ChannelPrefix + "/" + cfg.NodeId + "/availability"
 }
+
+// PublishDiscovery registers the entity and publishes its Homeassistant discovery message, through the discovery queue
+// if there is one.
+func PublishDiscovery(d Entity) {
+	appState := d.GetAppState()
+	appState.AddDiscoveryEntity(GetDiscoveryTopic(d), d)
+	if appState.Discovery != nil {
+		appState.Discovery.Add(d)
+	} else {
+		publishDiscovery(d)
+	}
+}
+
+// RepublishDiscovery publishes the discovery message and the state of a registered entity again.
+func RepublishDiscovery(d Entity) {
+	appState := d.GetAppState()
+	if appState.Discovery != nil {
+		appState.Discovery.Add(d)
+	} else {
+		publishDiscovery(d)
+		d.GetWindow().Dispatch(d.PublishState)
+	}
+}
+
+func publishDiscovery(d Entity) {
+	message, err := json.Marshal(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	token := d.GetAppState().Mqtt.Publish(GetDiscoveryTopic(d), 0, true, message)
+	token.Wait()
+}
+
+// ownTopic reports whether the topic belongs to this instance, rather than to a device like the output cover.
+func ownTopic(d Entity, topic string) bool {
+	cfg := d.GetAppState().Configuration
+	return strings.HasPrefix(topic, cfg.ChannelPrefix+"/"+cfg.NodeId+"/")
+}
+
+func GetControlTopic(cfg *CtrlConfig) string {
+	return cfg.ChannelPrefix + "/" + cfg.NodeId + "/control"
+}
+
+func GetControlReplyTopic(cfg *CtrlConfig) string {
+	return GetControlTopic(cfg) + "/reply"
+}
+
+// GetHomeassistantStatusTopic returns the topic of the Homeassistant birth and last will messages.
+func GetHomeassistantStatusTopic(cfg *CtrlConfig) string {
+	return cfg.DiscoverChannel + "/status"
+}
@@ -0,0 +1,25 @@
+package domain
+
+// Update records the position and automation switch of a window of the group. publish is called with the average
+// position and whether the automation of all windows is on, while holding the lock, so concurrent updates of the
+// windows are published in order.
+func (g *StateGroup) Update(windowId string, position int, automation bool, publish func(position int, automation bool)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.positions == nil {
+		g.positions = make(map[string]int)
+		g.automation = make(map[string]bool)
+	}
+	g.positions[windowId] = position
+	g.automation[windowId] = automation
+
+	sum := 0
+	for _, p := range g.positions {
+		sum += p
+	}
+	all := true
+	for _, w := range g.Windows {
+		all = all && g.automation[w.Id]
+	}
+	publish((sum+len(g.positions)/2)/len(g.positions), all)
+}
@@ -0,0 +1,233 @@
+package domain
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MqttClient is the part of the paho client used by the application. It is satisfied by mqtt.Client and by
+// MemoryClient.
+type MqttClient interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
+// MemoryMessage is a message published through a MemoryClient.
+type MemoryMessage struct {
+	Topic    string
+	Payload  string
+	Retained bool
+}
+
+// MemoryClient is an in-memory broker and client in one. Published messages are recorded and delivered to all
+// matching subscriptions in order by a delivery goroutine, like the paho router does. Retained messages are
+// delivered on subscribe.
+type MemoryClient struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	subscriptions map[string]mqtt.MessageHandler
+	retained      map[string]string
+	published     []MemoryMessage
+	queue         []memoryDelivery
+	busy          bool
+}
+
+type memoryDelivery struct {
+	message  *memoryMessage
+	handlers []mqtt.MessageHandler
+}
+
+func NewMemoryClient() *MemoryClient {
+	c := &MemoryClient{
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		retained:      make(map[string]string),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+func (c *MemoryClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := payloadString(payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, MemoryMessage{Topic: topic, Payload: p, Retained: retained})
+	if retained {
+		if p == "" {
+			delete(c.retained, topic)
+		} else {
+			c.retained[topic] = p
+		}
+	}
+	// Like a broker, the retained flag is only set on messages delivered on subscribe
+	c.enqueue(&memoryMessage{topic: topic, payload: []byte(p)}, nil)
+	return memoryToken{}
+}
+
+func (c *MemoryClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions[topic] = callback
+	for t, p := range c.retained {
+		if TopicMatches(topic, t) {
+			c.enqueue(&memoryMessage{topic: t, payload: []byte(p), retained: true}, callback)
+		}
+	}
+	return memoryToken{}
+}
+
+func (c *MemoryClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		delete(c.subscriptions, t)
+	}
+	return memoryToken{}
+}
+
+// Inject delivers a message to the subscribers as if it was received from the broker, without recording it.
+func (c *MemoryClient) Inject(topic string, payload string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enqueue(&memoryMessage{topic: topic, payload: []byte(payload)}, nil)
+}
+
+// Flush waits until all queued messages have been handed to the subscribers.
+func (c *MemoryClient) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) > 0 || c.busy {
+		c.cond.Wait()
+	}
+}
+
+// Published returns all messages published so far.
+func (c *MemoryClient) Published() []MemoryMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]MemoryMessage{}, c.published...)
+}
+
+// PublishedTo returns the payloads published to the given topic.
+func (c *MemoryClient) PublishedTo(topic string) []string {
+	payloads := make([]string, 0)
+	for _, m := range c.Published() {
+		if m.Topic == topic {
+			payloads = append(payloads, m.Payload)
+		}
+	}
+	return payloads
+}
+
+func (c *MemoryClient) Retained(topic string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.retained[topic]
+	return p, ok
+}
+
+func (c *MemoryClient) ClearPublished() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = nil
+}
+
+// enqueue queues the message for the given handler, or for all subscriptions matching at the time of publishing.
+func (c *MemoryClient) enqueue(message *memoryMessage, callback mqtt.MessageHandler) {
+	handlers := make([]mqtt.MessageHandler, 0)
+	if callback != nil {
+		handlers = append(handlers, callback)
+	} else {
+		for filter, h := range c.subscriptions {
+			if TopicMatches(filter, message.topic) {
+				handlers = append(handlers, h)
+			}
+		}
+	}
+	c.queue = append(c.queue, memoryDelivery{message: message, handlers: handlers})
+	c.cond.Broadcast()
+}
+
+func (c *MemoryClient) run() {
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 {
+			c.cond.Wait()
+		}
+		d := c.queue[0]
+		c.queue = c.queue[1:]
+		c.busy = true
+		c.mu.Unlock()
+
+		for _, h := range d.handlers {
+			h(nil, d.message)
+		}
+
+		c.mu.Lock()
+		c.busy = false
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// TopicMatches reports whether the topic matches the subscription filter, including `+` and `#` wildcards.
+func TopicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func payloadString(payload interface{}) string {
+	switch p := payload.(type) {
+	case string:
+		return p
+	case []byte:
+		return string(p)
+	case nil:
+		return ""
+	}
+	return ""
+}
+
+type memoryToken struct{}
+
+func (memoryToken) Wait() bool                     { return true }
+func (memoryToken) WaitTimeout(time.Duration) bool { return true }
+func (memoryToken) Done() <-chan struct{}          { return closedChannel }
+func (memoryToken) Error() error                   { return nil }
+
+var closedChannel = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+type memoryMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *memoryMessage) Duplicate() bool   { return false }
+func (m *memoryMessage) Qos() byte         { return 0 }
+func (m *memoryMessage) Retained() bool    { return m.retained }
+func (m *memoryMessage) Topic() string     { return m.topic }
+func (m *memoryMessage) MessageID() uint16 { return 0 }
+func (m *memoryMessage) Payload() []byte   { return m.payload }
+func (m *memoryMessage) Ack()              {}
@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a", true},
+		{"homeassistant/status", "homeassistant/status", true},
+	}
+	for _, tt := range tests {
+		if got := TopicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("TopicMatches(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryClientDelivery(t *testing.T) {
+	c := NewMemoryClient()
+	c.Publish("retained/topic", 0, true, "kept")
+	c.Publish("other/topic", 0, false, "lost")
+
+	received := make([]string, 0)
+	c.Subscribe("+/topic", 0, func(client mqtt.Client, msg mqtt.Message) {
+		received = append(received, msg.Topic()+"="+string(msg.Payload()))
+	})
+	c.Flush()
+	c.Publish("other/topic", 0, false, []byte("live"))
+	c.Inject("retained/topic", "injected")
+	c.Flush()
+
+	want := []string{"retained/topic=kept", "other/topic=live", "retained/topic=injected"}
+	if len(received) != len(want) {
+		t.Fatalf("received %v, want %v", received, want)
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("received[%d] = %q, want %q", i, received[i], want[i])
+		}
+	}
+	if n := len(c.Published()); n != 3 {
+		t.Errorf("recorded %d published messages, want 3", n)
+	}
+
+	c.Publish("retained/topic", 0, true, nil)
+	if _, ok := c.Retained("retained/topic"); ok {
+		t.Error("empty retained payload did not clear the retained message")
+	}
+}
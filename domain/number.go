@@ -0,0 +1,189 @@
+package domain
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	strcase "github.com/iancoleman/strcase"
+	"log"
+	"shutter_control/common"
+)
+
+// see https://www.home-assistant.io/integrations/number.mqtt/
+
+type Number struct {
+	AvailabilityMode       *string                          `json:"availability_mode,omitempty"`     // "When `availability` is configured, this controls the conditions needed to set the entity to `available`. Valid entries are `all`, `any`, and `latest`."
+	AvailabilityTemplate   *string                          `json:"availability_template,omitempty"` // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) to extract device's availability from the `availability_topic`."
+	AvailabilityTopic      *string                          `json:"availability_topic,omitempty"`    // "The MQTT topic subscribed to receive availability (online/offline) updates. Must not be used together with `availability`."
+	CommandTemplate        *string                          `json:"command_template,omitempty"`      // "Defines a [template](/docs/configuration/templating/#using-command-templates-with-mqtt) to generate the payload to send to `command_topic`."
+	CommandTopic           *string                          `json:"command_topic,omitempty"`         // "The MQTT topic to publish commands to change the number."
+	CommandFunc            mqtt.MessageHandler              `json:"-"`
+	Device                 *Device                          `json:"device,omitempty"`
+	DeviceClass            *string                          `json:"device_class,omitempty"`             // "The [type/class](/integrations/number/#device-class) of the number."
+	EnabledByDefault       *bool                            `json:"enabled_by_default,omitempty"`       // "Flag which defines if the entity should be enabled when first added."
+	Encoding               *string                          `json:"encoding,omitempty"`                 // "The encoding of the payloads received and published messages. Set to `\"\"` to disable decoding of incoming payload."
+	EntityCategory         *string                          `json:"entity_category,omitempty"`          // "The [category](https://developers.home-assistant.io/docs/core/entity#generic-properties) of the entity."
+	Icon                   *string                          `json:"icon,omitempty"`                     // "[Icon](/docs/configuration/customizing-devices/#icon) for the entity."
+	JsonAttributesTemplate *string                          `json:"json_attributes_template,omitempty"` // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) to extract the JSON dictionary from messages received on the `json_attributes_topic`."
+	JsonAttributesTopic    *string                          `json:"json_attributes_topic,omitempty"`    // "The MQTT topic subscribed to receive a JSON dictionary payload and then set as number attributes."
+	Max                    *float64                         `json:"max,omitempty"`                      // "Maximum value."
+	Min                    *float64                         `json:"min,omitempty"`                      // "Minimum value."
+	Mode                   *string                          `json:"mode,omitempty"`                     // "Control how the number should be displayed in the UI. Can be set to `box` or `slider` to force a display mode."
+	Name                   *string                          `json:"name,omitempty"`                     // "The name of the Number."
+	ObjectId               *string                          `json:"object_id,omitempty"`                // "Used instead of `name` for automatic generation of `entity_id`"
+	Optimistic             *bool                            `json:"optimistic,omitempty"`               // "Flag that defines if number works in optimistic mode."
+	PayloadReset           *string                          `json:"payload_reset,omitempty"`            // "A special payload that resets the state to `unknown` when received on the `state_topic`."
+	Qos                    *int                             `json:"qos,omitempty"`                      // "The maximum QoS level of the state topic. Default is 0 and will also be used to publishing messages."
+	Retain                 *bool                            `json:"retain,omitempty"`                   // "If the published message should have the retain flag on or not."
+	StateTopic             *string                          `json:"state_topic,omitempty"`              // "The MQTT topic subscribed to receive number values."
+	State                  *string                          `json:"-"`
+	Step                   *float64                         `json:"step,omitempty"`                // "Step value. Smallest value `0.001`."
+	UniqueId               *string                          `json:"unique_id,omitempty"`           // "An ID that uniquely identifies this number. If two numbers have the same unique ID, Home Assistant will raise an exception."
+	UnitOfMeasurement      *string                          `json:"unit_of_measurement,omitempty"` // "Defines the unit of measurement of the sensor, if any."
+	ValueTemplate          *string                          `json:"value_template,omitempty"`      // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) to extract the value."
+	AppState               *State                           `json:"-"`
+	Window                 *StateWindow                     `json:"-"`
+	StateUpdatedFunc       *func(*Number, *string, *string) `json:"-"`
+	echo                   echoFilter
+}
+
+func (d *Number) GetRawId() string {
+	return "number"
+}
+
+func (d *Number) GetUniqueId() string {
+	return *d.UniqueId
+}
+func (d *Number) UpdateState(state *string) {
+	if state != nil {
+		d.State = state
+	}
+
+	common.LogDebug(fmt.Sprintf("Set number state %s=%s", *d.UniqueId, *d.State))
+	token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, *d.State)
+	token.Wait()
+}
+
+func (d *Number) Subscribe() {
+	c := d.AppState.Mqtt
+	if d.CommandFunc != nil {
+		if d.Window != nil {
+			d.AppState.RegisterTopic(*d.CommandTopic, d.Window)
+		}
+		t := c.Subscribe(*d.CommandTopic, 0, d.CommandFunc)
+		t.Wait()
+		if t.Error() != nil {
+			log.Fatal(t.Error())
+		}
+
+		PublishDiscovery(d)
+		d.UpdateState(nil)
+	}
+
+	if d.StateTopic != nil {
+		t := c.Subscribe(*d.StateTopic, 0, d.handleStateUpdate())
+		t.Wait()
+		if t.Error() != nil {
+			log.Fatal(t.Error())
+		}
+	}
+}
+
+func (d *Number) handleStateUpdate() func(client mqtt.Client, msg mqtt.Message) {
+
+	return func(client mqtt.Client, msg mqtt.Message) {
+		newState := string(msg.Payload())
+		d.Window.Dispatch(func() {
+			if d.echo.consume(newState) {
+				return
+			}
+			oldState := d.State
+
+			if newState != *oldState {
+				d.State = &newState
+				common.LogDebug(fmt.Sprintf("Number state %s=%s", *d.UniqueId, *d.State))
+			}
+
+			d.AppState.SetState(*d.UniqueId, newState)
+
+			if d.StateUpdatedFunc != nil {
+				(*d.StateUpdatedFunc)(d, oldState, &newState)
+			}
+		})
+	}
+
+}
+func (d *Number) UnSubscribe() {
+	c := d.AppState.Mqtt
+	if d.CommandTopic != nil {
+		t := c.Unsubscribe(*d.CommandTopic)
+		t.Wait()
+		if t.Error() != nil {
+			log.Fatal(t.Error())
+		}
+	}
+	if d.StateTopic != nil {
+		t := c.Unsubscribe(*d.StateTopic)
+		t.Wait()
+		if t.Error() != nil {
+			log.Fatal(t.Error())
+		}
+	}
+}
+func (d *Number) Initialize() {
+	if d.Qos == nil {
+		d.Qos = new(int)
+		*d.Qos = int(common.QoS)
+	}
+	if d.Retain == nil {
+		d.Retain = new(bool)
+		*d.Retain = common.Retain
+	}
+	if d.UniqueId == nil {
+		d.UniqueId = new(string)
+		*d.UniqueId = d.AppState.Configuration.NodeId + "_" + strcase.ToSnake(*d.Name)
+
+	}
+	if d.State == nil {
+		d.State = new(string)
+		*d.State = "0"
+	}
+	d.PopulateTopics()
+
+	if val, ok := d.AppState.GetState(*d.UniqueId); ok {
+		d.State = new(string)
+		*d.State = val
+	}
+}
+func (d *Number) PopulateTopics() {
+
+	d.AvailabilityTopic = new(string)
+	*d.AvailabilityTopic = GetAvailabilityTopic(d.AppState.Configuration)
+
+	if d.CommandFunc != nil {
+		d.CommandTopic = new(string)
+		*d.CommandTopic = GetTopic(d, "command_topic")
+	}
+
+	d.StateTopic = new(string)
+	*d.StateTopic = GetTopic(d, "state_topic")
+}
+
+func (d *Number) GetAppState() *State {
+	return d.AppState
+}
+
+func (d *Number) SetAppState(appState *State) {
+	d.AppState = appState
+}
+
+func (d *Number) GetWindow() *StateWindow {
+	return d.Window
+}
+
+func (d *Number) PublishState() {
+	if d.State != nil {
+		d.echo.expect(*d.State)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, *d.State)
+		token.Wait()
+	}
+}
@@ -0,0 +1,232 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// Priorities of cover commands, commands with a higher priority are sent first.
+const (
+	PriorityNormal = iota
+	PriorityManual
+	PriorityRain
+)
+
+// ScheduledCommand is a command for an output cover waiting to be sent.
+type ScheduledCommand struct {
+	Cover    *Cover
+	Command  string
+	Priority int
+	// Moving commands start the motor and take a slot until the cover reports it stopped or Timeout passed
+	Moving  bool
+	Timeout time.Duration
+	// Write sends the command instead of writing it to Cover, e.g. to several covers, optional
+	Write func()
+	// Sent is called once the command is sent, optional
+	Sent func()
+}
+
+// CommandScheduler sends the commands of the output covers in the background, so not all motors start at once. At
+// most MaxMoving covers move at the same time (0 for no limit) and commands are sent at least Spacing apart. A cover
+// has at most one pending command, a newer command replaces it.
+type CommandScheduler struct {
+	MaxMoving int
+	Spacing   time.Duration
+	mu        sync.Mutex
+	pending   []*ScheduledCommand
+	moving    map[*Cover]*time.Timer
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func NewCommandScheduler(maxMoving int, spacing time.Duration) *CommandScheduler {
+	return &CommandScheduler{
+		MaxMoving: maxMoving,
+		Spacing:   spacing,
+		moving:    make(map[*Cover]*time.Timer),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (s *CommandScheduler) Start() {
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.run()
+}
+
+// Stop ends sending, commands still pending are dropped.
+func (s *CommandScheduler) Stop() {
+	if s.done != nil {
+		close(s.done)
+		<-s.stopped
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.moving {
+		t.Stop()
+	}
+}
+
+func (s *CommandScheduler) Add(c *ScheduledCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(c.Cover)
+	s.pending = append(s.pending, c)
+	s.notify()
+}
+
+// Cancel drops the pending command of the cover, e.g. when it is already at the position wanted.
+func (s *CommandScheduler) Cancel(cover *Cover) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(cover)
+}
+
+// Stopped frees the slot of a cover once it reports to have stopped.
+func (s *CommandScheduler) Stopped(cover *Cover) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.moving[cover]; ok {
+		t.Stop()
+		delete(s.moving, cover)
+		s.notify()
+	}
+}
+
+// Len returns the number of commands waiting to be sent.
+func (s *CommandScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Moving returns the number of covers considered moving.
+func (s *CommandScheduler) Moving() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.moving)
+}
+
+func (s *CommandScheduler) remove(cover *Cover) {
+	for i, p := range s.pending {
+		if p.Cover == cover {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *CommandScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the pending command with the highest priority which may be sent now, the oldest one first. A cover
+// already moving may always be redirected.
+func (s *CommandScheduler) next() *ScheduledCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	best := -1
+	for i, c := range s.pending {
+		_, isMoving := s.moving[c.Cover]
+		if c.Moving && !isMoving && s.MaxMoving > 0 && len(s.moving) >= s.MaxMoving {
+			continue
+		}
+		if best == -1 || c.Priority > s.pending[best].Priority {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	c := s.pending[best]
+	s.pending = append(s.pending[:best], s.pending[best+1:]...)
+
+	if t, ok := s.moving[c.Cover]; ok {
+		t.Stop()
+		delete(s.moving, c.Cover)
+	}
+	if c.Moving {
+		cover := c.Cover
+		s.moving[cover] = time.AfterFunc(c.Timeout, func() {
+			s.Stopped(cover)
+		})
+	}
+	return c
+}
+
+func (s *CommandScheduler) run() {
+	defer close(s.stopped)
+	for {
+		c := s.next()
+		if c == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		c.send()
+
+		select {
+		case <-time.After(s.Spacing):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// ScheduleCommand sends a command to an output cover through the scheduler of the application, without a scheduler
+// it is sent right away.
+func ScheduleCommand(c *ScheduledCommand) {
+	if s := c.Cover.AppState.Commands; s != nil {
+		s.Add(c)
+		return
+	}
+	c.send()
+}
+
+func (c *ScheduledCommand) send() {
+	if c.Write != nil {
+		c.Write()
+	} else {
+		c.Cover.WriteCommand(&c.Command)
+	}
+	if c.Sent != nil {
+		c.Sent()
+	}
+}
+
+// Arm calls fn after d, replacing a timer armed before. Does nothing once the ack is stopped.
+func (a *CommandAck) Arm(d time.Duration, fn func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.timer = time.AfterFunc(d, fn)
+}
+
+// Stop ends tracking the command.
+func (a *CommandAck) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func newSchedulerTestCovers(t *testing.T, scheduler *CommandScheduler, names ...string) (*MemoryClient, []*Cover) {
+	client := NewMemoryClient()
+	state := &State{
+		Mqtt:          client,
+		Configuration: &CtrlConfig{NodeId: "test", ChannelPrefix: "shutter_control", DiscoverChannel: "homeassistant"},
+		Topics:        make(map[string]*StateWindow),
+		States:        make(map[string]string),
+		Commands:      scheduler,
+	}
+	covers := make([]*Cover, 0)
+	for _, n := range names {
+		name := n
+		c := &Cover{Name: &name, AppState: state, CommandFunc: func(_ mqtt.Client, _ mqtt.Message) {}}
+		c.Initialize(false)
+		covers = append(covers, c)
+	}
+	scheduler.Start()
+	t.Cleanup(scheduler.Stop)
+	return client, covers
+}
+
+// waitCommands waits until n commands are sent and returns the covers they were sent to in order.
+func waitCommands(t *testing.T, client *MemoryClient, covers []*Cover, n int) []string {
+	t.Helper()
+	topics := make(map[string]string)
+	for _, c := range covers {
+		topics[*c.CommandTopic] = *c.Name
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sent := make([]string, 0)
+		for _, m := range client.Published() {
+			if name, ok := topics[m.Topic]; ok {
+				sent = append(sent, name)
+			}
+		}
+		if len(sent) >= n || time.Now().After(deadline) {
+			return sent
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommandSchedulerPriorityAndSlots(t *testing.T) {
+	scheduler := NewCommandScheduler(1, 0)
+	client, covers := newSchedulerTestCovers(t, scheduler, "a", "b", "c", "d")
+	a, b, c, d := covers[0], covers[1], covers[2], covers[3]
+
+	// Occupy the only slot, so the next commands queue up
+	ScheduleCommand(&ScheduledCommand{Cover: a, Command: "1", Moving: true, Timeout: time.Minute})
+	waitCommands(t, client, covers, 1)
+	ScheduleCommand(&ScheduledCommand{Cover: b, Command: "1", Moving: true, Timeout: time.Minute})
+	ScheduleCommand(&ScheduledCommand{Cover: c, Command: "1", Moving: true, Timeout: time.Minute})
+	ScheduleCommand(&ScheduledCommand{Cover: b, Command: "2", Moving: true, Timeout: time.Minute})
+	ScheduleCommand(&ScheduledCommand{Cover: d, Command: "1", Priority: PriorityRain, Moving: true, Timeout: time.Minute})
+	time.Sleep(20 * time.Millisecond)
+	if n := scheduler.Len(); n != 3 {
+		t.Fatalf("%d commands pending, want 3 as the first command of b was replaced", n)
+	}
+
+	// Stopping a does not need a slot and frees the slot of a
+	ScheduleCommand(&ScheduledCommand{Cover: a, Command: "STOP"})
+	if sent := waitCommands(t, client, covers, 3); len(sent) != 3 || sent[1] != "a" || sent[2] != "d" {
+		t.Fatalf("sent %v, want the stop of a followed by the rain command of d", sent)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(waitCommands(t, client, covers, 0)); n != 3 {
+		t.Fatalf("sent %d commands while d is moving, want 3", n)
+	}
+
+	scheduler.Stopped(d)
+	waitCommands(t, client, covers, 4)
+	scheduler.Stopped(c)
+	sent := waitCommands(t, client, covers, 5)
+	if want := []string{"a", "a", "d", "c", "b"}; fmt.Sprint(sent) != fmt.Sprint(want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	if last := client.PublishedTo(*b.CommandTopic); len(last) != 1 || last[0] != "2" {
+		t.Errorf("b received %v, want the replaced command 2 only", last)
+	}
+}
+
+func TestCommandSchedulerTimeout(t *testing.T) {
+	scheduler := NewCommandScheduler(1, 0)
+	client, covers := newSchedulerTestCovers(t, scheduler, "a", "b")
+
+	start := time.Now()
+	ScheduleCommand(&ScheduledCommand{Cover: covers[0], Command: "1", Moving: true, Timeout: 50 * time.Millisecond})
+	ScheduleCommand(&ScheduledCommand{Cover: covers[1], Command: "1", Moving: true, Timeout: time.Minute})
+	waitCommands(t, client, covers, 2)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("second command sent after %s, want the slot to be freed after the timeout", elapsed)
+	}
+	if n := scheduler.Moving(); n != 1 {
+		t.Errorf("%d covers moving, want 1", n)
+	}
+}
+
+func TestCommandSchedulerSpacing(t *testing.T) {
+	scheduler := NewCommandScheduler(0, 30*time.Millisecond)
+	client, covers := newSchedulerTestCovers(t, scheduler, "a", "b", "c")
+
+	start := time.Now()
+	for _, c := range covers {
+		ScheduleCommand(&ScheduledCommand{Cover: c, Command: "1", Moving: true, Timeout: time.Minute})
+	}
+	waitCommands(t, client, covers, 3)
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("3 commands sent within %s, want them spaced", elapsed)
+	}
+	if n := scheduler.Moving(); n != 3 {
+		t.Errorf("%d covers moving, want 3 without a limit", n)
+	}
+}
+
+func TestCommandSchedulerWrite(t *testing.T) {
+	scheduler := NewCommandScheduler(0, 0)
+	client, covers := newSchedulerTestCovers(t, scheduler, "a", "b")
+
+	// Both covers are written by the command of the first one
+	written := make(chan struct{})
+	ScheduleCommand(&ScheduledCommand{Cover: covers[0], Command: "1", Moving: true, Timeout: time.Minute, Write: func() {
+		for _, c := range covers {
+			c.WriteCommand(String("1"))
+		}
+		close(written)
+	}})
+	<-written
+	if sent := waitCommands(t, client, covers, 2); fmt.Sprint(sent) != "[a b]" {
+		t.Errorf("sent to %v, want both covers", sent)
+	}
+	if n := scheduler.Moving(); n != 1 {
+		t.Errorf("%d covers moving, want a single slot", n)
+	}
+}
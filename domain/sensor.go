@@ -1,13 +1,11 @@
 package domain
 
 import (
-	"encoding/json"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/iancoleman/strcase"
 	"log"
 	"shutter_control/common"
-	"time"
 )
 
 // see https://github.com/W-Floyd/ha-mqtt-iot/blob/main/devices/externaldevice/binary_sensor.go
@@ -28,19 +26,23 @@ type Sensor struct {
 	JsonAttributesTopic    *string                          `json:"json_attributes_topic,omitempty"`    // "The MQTT topic subscribed to receive a JSON dictionary payload and then set as sensor attributes. Usage example can be found in [MQTT sensor](/integrations/sensor.mqtt/#json-attributes-topic-configuration) documentation."
 	Name                   *string                          `json:"name,omitempty"`                     // "The name of the binary sensor."
 	ObjectId               *string                          `json:"object_id,omitempty"`                // "Used instead of `name` for automatic generation of `entity_id`"
+	Options                *([]string)                      `json:"options,omitempty"`                  // "List of allowed sensor state value. An empty list is not allowed. The sensor's `device_class` must be set to `enum`."
 	OffDelay               *int                             `json:"off_delay,omitempty"`                // "For sensors that only send `on` state updates (like PIRs), this variable sets a delay in seconds after which the sensor's state will be updated back to `off`."
 	PayloadAvailable       *string                          `json:"payload_available,omitempty"`        // "The string that represents the `online` state."
 	PayloadNotAvailable    *string                          `json:"payload_not_available,omitempty"`    // "The string that represents the `offline` state."
 	PayloadOff             *string                          `json:"payload_off,omitempty"`              // "The string that represents the `off` state. It will be compared to the message in the `state_topic` (see `value_template` for details)"
 	PayloadOn              *string                          `json:"payload_on,omitempty"`               // "The string that represents the `on` state. It will be compared to the message in the `state_topic` (see `value_template` for details)"
 	Qos                    *int                             `json:"qos,omitempty"`                      // "The maximum QoS level to be used when receiving messages."
+	StateClass             *string                          `json:"state_class,omitempty"`              // "The [state_class](https://developers.home-assistant.io/docs/core/entity/sensor#available-state-classes) of the sensor."
 	StateTopic             *string                          `json:"state_topic,omitempty"`              // "The MQTT topic subscribed to receive sensor's state."
 	UniqueId               *string                          `json:"unique_id,omitempty"`                // "An ID that uniquely identifies this sensor. If two sensors have the same unique ID, Home Assistant will raise an exception."
+	UnitOfMeasurement      *string                          `json:"unit_of_measurement,omitempty"`      // "Defines the units of measurement of the sensor, if any."
 	ValueTemplate          *string                          `json:"value_template,omitempty"`           // "Defines a [template](/docs/configuration/templating/#using-templates-with-the-mqtt-integration) that returns a string to be compared to `payload_on`/`payload_off` or an empty string, in which case the MQTT message will be removed. Available variables: `entity_id`. Remove this option when 'payload_on' and 'payload_off' are sufficient to match your payloads (i.e no pre-processing of original message is required)."
 	AppState               *State                           `json:"-"`
 	State                  *string                          `json:"-"`
 	StateUpdatedFunc       *func(*Sensor, *string, *string) `json:"-"`
-	Window                 *StateWindow                     `json:"-"`
+	echo                   echoFilter
+	Window                 *StateWindow `json:"-"`
 }
 
 func (d *Sensor) GetRawId() string {
@@ -55,24 +57,20 @@ func (d *Sensor) UpdateState(state *string) {
 		d.State = state
 		common.LogDebug(fmt.Sprintf("Set Sensor state %s=%s", *d.UniqueId, *d.State))
 
-		token := (*d.AppState.Mqtt).Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
 		token.Wait()
 	} else {
 		d.State = state
 		common.LogDebug(fmt.Sprintf("Set Sensor state %s=nil", *d.UniqueId))
 
-		token := (*d.AppState.Mqtt).Publish(*d.StateTopic, byte(*d.Qos), false, nil)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), false, nil)
 		token.Wait()
 	}
 
 }
 
 func (d *Sensor) Subscribe() {
-	c := *d.AppState.Mqtt
-	message, err := json.Marshal(d)
-	if err != nil {
-		log.Fatal(err)
-	}
+	c := d.AppState.Mqtt
 
 	if d.StateTopic != nil {
 		t := c.Subscribe(*d.StateTopic, 0, d.handleStateUpdate())
@@ -82,32 +80,35 @@ func (d *Sensor) Subscribe() {
 		}
 	}
 
-	token := c.Publish(GetDiscoveryTopic(d), 0, true, message)
-	token.Wait()
-	time.Sleep(common.HADiscoveryDelay)
+	PublishDiscovery(d)
 }
 
 func (d *Sensor) handleStateUpdate() func(client mqtt.Client, msg mqtt.Message) {
 
 	return func(client mqtt.Client, msg mqtt.Message) {
 		newState := string(msg.Payload())
-		oldState := d.State
-
-		if oldState == nil || newState != *oldState {
-			d.State = &newState
-			common.LogDebug(fmt.Sprintf("Sensor state %s=%s", *d.UniqueId, *d.State))
-		}
-
-		d.AppState.States[*d.UniqueId] = newState
-
-		if d.StateUpdatedFunc != nil {
-			(*d.StateUpdatedFunc)(d, oldState, &newState)
-		}
+		d.Window.Dispatch(func() {
+			if d.echo.consume(newState) {
+				return
+			}
+			oldState := d.State
+
+			if oldState == nil || newState != *oldState {
+				d.State = &newState
+				common.LogDebug(fmt.Sprintf("Sensor state %s=%s", *d.UniqueId, *d.State))
+			}
+
+			d.AppState.SetState(*d.UniqueId, newState)
+
+			if d.StateUpdatedFunc != nil {
+				(*d.StateUpdatedFunc)(d, oldState, &newState)
+			}
+		})
 	}
 
 }
 func (d *Sensor) UnSubscribe() {
-	c := *d.AppState.Mqtt
+	c := d.AppState.Mqtt
 	if d.StateTopic != nil {
 		t := c.Unsubscribe(*d.StateTopic)
 		t.Wait()
@@ -131,7 +132,7 @@ func (d *Sensor) Initialize() {
 		d.State = String("")
 	}
 	d.PopulateTopics()
-	if val, ok := d.AppState.States[*d.UniqueId]; ok {
+	if val, ok := d.AppState.GetState(*d.UniqueId); ok {
 		d.State = new(string)
 		*d.State = val
 	}
@@ -154,3 +155,15 @@ func (d *Sensor) GetAppState() *State {
 func (d *Sensor) SetAppState(appState *State) {
 	d.AppState = appState
 }
+
+func (d *Sensor) GetWindow() *StateWindow {
+	return d.Window
+}
+
+func (d *Sensor) PublishState() {
+	if d.State != nil {
+		d.echo.expect(*d.State)
+		token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), false, *d.State)
+		token.Wait()
+	}
+}
@@ -0,0 +1,75 @@
+package domain
+
+import "sort"
+
+// SetState stores a value in the persisted state map.
+func (s *State) SetState(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.States[key] = value
+}
+
+func (s *State) GetState(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.States[key]
+	return val, ok
+}
+
+// CopyStates returns a snapshot of the persisted state map, safe to be serialized while handlers keep running.
+func (s *State) CopyStates() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := make(map[string]string, len(s.States))
+	for k, v := range s.States {
+		c[k] = v
+	}
+	return c
+}
+
+// RegisterTopic remembers the window a command topic belongs to.
+func (s *State) RegisterTopic(topic string, window *StateWindow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Topics[topic] = window
+}
+
+func (s *State) WindowForTopic(topic string) *StateWindow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Topics[topic]
+}
+
+// AddDiscoveryEntity remembers an entity and the discovery topic published for it.
+func (s *State) AddDiscoveryEntity(topic string, entity Entity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.discovery == nil {
+		s.discovery = make(map[string]Entity)
+	}
+	s.discovery[topic] = entity
+}
+
+// DiscoveryTopics returns the discovery topics published by this instance, sorted.
+func (s *State) DiscoveryTopics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make([]string, 0, len(s.discovery))
+	for t := range s.discovery {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// DiscoveryEntities returns the entities a discovery message was published for, ordered by discovery topic.
+func (s *State) DiscoveryEntities() []Entity {
+	topics := s.DiscoveryTopics()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entities := make([]Entity, 0, len(topics))
+	for _, t := range topics {
+		entities = append(entities, s.discovery[t])
+	}
+	return entities
+}
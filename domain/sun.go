@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"math"
+	"time"
+)
+
+// SunPosition returns the azimuth, clockwise from north, and the elevation of the sun in degrees at the given
+// location, following the NOAA solar calculator.
+func SunPosition(t time.Time, latitude float64, longitude float64) (azimuth float64, elevation float64) {
+	t = t.UTC()
+	julianDay := float64(t.Unix())/86400 + 2440587.5
+	century := (julianDay - 2451545) / 36525
+
+	meanLong := math.Mod(280.46646+century*(36000.76983+century*0.0003032), 360)
+	meanAnom := 357.52911 + century*(35999.05029-0.0001537*century)
+	eccent := 0.016708634 - century*(0.000042037+0.0000001267*century)
+	center := math.Sin(rad(meanAnom))*(1.914602-century*(0.004817+0.000014*century)) +
+		math.Sin(rad(2*meanAnom))*(0.019993-0.000101*century) +
+		math.Sin(rad(3*meanAnom))*0.000289
+	appLong := meanLong + center - 0.00569 - 0.00478*math.Sin(rad(125.04-1934.136*century))
+	meanObliq := 23 + (26+(21.448-century*(46.815+century*(0.00059-century*0.001813)))/60)/60
+	obliq := meanObliq + 0.00256*math.Cos(rad(125.04-1934.136*century))
+	declination := deg(math.Asin(math.Sin(rad(obliq)) * math.Sin(rad(appLong))))
+
+	y := math.Pow(math.Tan(rad(obliq/2)), 2)
+	equationOfTime := 4 * deg(y*math.Sin(2*rad(meanLong))-2*eccent*math.Sin(rad(meanAnom))+
+		4*eccent*y*math.Sin(rad(meanAnom))*math.Cos(2*rad(meanLong))-
+		0.5*y*y*math.Sin(4*rad(meanLong))-1.25*eccent*eccent*math.Sin(2*rad(meanAnom)))
+
+	minutes := float64(t.Hour()*60+t.Minute()) + float64(t.Second())/60
+	trueSolarTime := math.Mod(minutes+equationOfTime+4*longitude, 1440)
+	if trueSolarTime < 0 {
+		trueSolarTime += 1440
+	}
+	hourAngle := trueSolarTime/4 - 180
+
+	cosZenith := math.Sin(rad(latitude))*math.Sin(rad(declination)) +
+		math.Cos(rad(latitude))*math.Cos(rad(declination))*math.Cos(rad(hourAngle))
+	zenith := deg(math.Acos(math.Max(-1, math.Min(1, cosZenith))))
+	elevation = 90 - zenith
+
+	cosAzimuth := (math.Sin(rad(latitude))*math.Cos(rad(zenith)) - math.Sin(rad(declination))) /
+		(math.Cos(rad(latitude)) * math.Sin(rad(zenith)))
+	a := deg(math.Acos(math.Max(-1, math.Min(1, cosAzimuth))))
+	if hourAngle > 0 {
+		azimuth = math.Mod(a+180, 360)
+	} else {
+		azimuth = math.Mod(540-a, 360)
+	}
+	return azimuth, elevation
+}
+
+// SunOnFacade reports whether the sun is up and shines on a facade facing the given azimuth.
+func SunOnFacade(azimuth float64, elevation float64, facade float64) bool {
+	diff := math.Mod(azimuth-facade+540, 360) - 180
+	return elevation > 0 && math.Abs(diff) < 90
+}
+
+func rad(d float64) float64 { return d * math.Pi / 180 }
+func deg(r float64) float64 { return r * 180 / math.Pi }
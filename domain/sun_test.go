@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSunPosition(t *testing.T) {
+	tests := []struct {
+		name          string
+		time          time.Time
+		latitude      float64
+		longitude     float64
+		wantAzimuth   float64
+		wantElevation float64
+	}{
+		// Solar noon on the summer solstice, 90 - 52.52 + 23.44
+		{"berlin solstice noon", time.Date(2024, 6, 21, 11, 7, 0, 0, time.UTC), 52.52, 13.405, 180, 60.9},
+		// The sun rises in the east on the equinox
+		{"equinox sunrise", time.Date(2024, 3, 20, 6, 7, 0, 0, time.UTC), 48, 0, 90, 0},
+		{"equinox sunset", time.Date(2024, 3, 20, 18, 7, 0, 0, time.UTC), 48, 0, 270, 0},
+		{"midnight", time.Date(2024, 12, 21, 23, 0, 0, 0, time.UTC), 52.52, 13.405, 0, -60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azimuth, elevation := SunPosition(tt.time, tt.latitude, tt.longitude)
+			if math.Abs(elevation-tt.wantElevation) > 2 {
+				t.Errorf("elevation = %.1f, want %.1f", elevation, tt.wantElevation)
+			}
+			diff := math.Mod(azimuth-tt.wantAzimuth+540, 360) - 180
+			if tt.wantElevation > -50 && math.Abs(diff) > 3 {
+				t.Errorf("azimuth = %.1f, want %.1f", azimuth, tt.wantAzimuth)
+			}
+		})
+	}
+}
+
+func TestSunOnFacade(t *testing.T) {
+	tests := []struct {
+		azimuth   float64
+		elevation float64
+		facade    float64
+		want      bool
+	}{
+		{180, 30, 180, true},
+		{100, 30, 180, true},
+		{80, 30, 180, false},
+		{350, 30, 10, true},
+		{180, -5, 180, false},
+	}
+	for _, tt := range tests {
+		if got := SunOnFacade(tt.azimuth, tt.elevation, tt.facade); got != tt.want {
+			t.Errorf("SunOnFacade(%v, %v, %v) = %t, want %t", tt.azimuth, tt.elevation, tt.facade, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package domain
 
 import (
-	"encoding/json"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	strcase "github.com/iancoleman/strcase"
 	"log"
 	"shutter_control/common"
-	"time"
+	"sync"
 )
 
 // see https://github.com/W-Floyd/ha-mqtt-iot/blob/main/devices/externaldevice/switch.go
@@ -44,6 +43,8 @@ type Switch struct {
 	AppState               *State                           `json:"-"`
 	Window                 *StateWindow                     `json:"-"`
 	StateUpdatedFunc       *func(*Switch, *string, *string) `json:"-"`
+	echo                   echoFilter
+	mu                     sync.RWMutex
 }
 
 func (d *Switch) GetRawId() string {
@@ -54,34 +55,42 @@ func (d *Switch) GetUniqueId() string {
 	return *d.UniqueId
 }
 func (d *Switch) UpdateState(state *string) {
+	d.mu.Lock()
 	if state != nil {
 		d.State = state
 	}
+	current := *d.State
+	d.mu.Unlock()
 
-	common.LogDebug(fmt.Sprintf("Set switch state %s=%s", *d.UniqueId, *d.State))
-	token := (*d.AppState.Mqtt).Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, *d.State)
+	common.LogDebug(fmt.Sprintf("Set switch state %s=%s", *d.UniqueId, current))
+	token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, current)
 	token.Wait()
 }
 
-func (d *Switch) Subscribe() {
-	c := *d.AppState.Mqtt
-	message, err := json.Marshal(d)
-	if err != nil {
-		log.Fatal(err)
+// GetState returns the current state. Switches of the controller are read by all windows, so their state is guarded
+// by a lock.
+func (d *Switch) GetState() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.State == nil {
+		return ""
 	}
+	return *d.State
+}
+
+func (d *Switch) Subscribe() {
+	c := d.AppState.Mqtt
 	if d.CommandFunc != nil {
+		if d.Window != nil {
+			d.AppState.RegisterTopic(*d.CommandTopic, d.Window)
+		}
 		t := c.Subscribe(*d.CommandTopic, 0, d.CommandFunc)
 		t.Wait()
 		if t.Error() != nil {
 			log.Fatal(t.Error())
 		}
-		if d.Window != nil {
-			d.AppState.Topics[*d.CommandTopic] = d.Window
-		}
 
-		token := c.Publish(GetDiscoveryTopic(d), 0, true, message)
-		token.Wait()
-		time.Sleep(common.HADiscoveryDelay)
+		PublishDiscovery(d)
 		d.UpdateState(nil)
 	}
 
@@ -98,23 +107,30 @@ func (d *Switch) handleStateUpdate() func(client mqtt.Client, msg mqtt.Message)
 
 	return func(client mqtt.Client, msg mqtt.Message) {
 		newState := string(msg.Payload())
-		oldState := d.State
-
-		if newState != *oldState {
-			d.State = &newState
-			common.LogDebug(fmt.Sprintf("Switch state %s=%s", *d.UniqueId, *d.State))
-		}
-
-		d.AppState.States[*d.UniqueId] = newState
-
-		if d.StateUpdatedFunc != nil {
-			(*d.StateUpdatedFunc)(d, &newState, oldState)
-		}
+		d.Window.Dispatch(func() {
+			if d.echo.consume(newState) {
+				return
+			}
+			d.mu.Lock()
+			oldState := d.State
+
+			if newState != *oldState {
+				d.State = &newState
+				common.LogDebug(fmt.Sprintf("Switch state %s=%s", *d.UniqueId, *d.State))
+			}
+			d.mu.Unlock()
+
+			d.AppState.SetState(*d.UniqueId, newState)
+
+			if d.StateUpdatedFunc != nil {
+				(*d.StateUpdatedFunc)(d, &newState, oldState)
+			}
+		})
 	}
 
 }
 func (d *Switch) UnSubscribe() {
-	c := *d.AppState.Mqtt
+	c := d.AppState.Mqtt
 	if d.CommandTopic != nil {
 		t := c.Unsubscribe(*d.CommandTopic)
 		t.Wait()
@@ -150,7 +166,7 @@ func (d *Switch) Initialize() {
 	}
 	d.PopulateTopics()
 
-	if val, ok := d.AppState.States[*d.UniqueId]; ok {
+	if val, ok := d.AppState.GetState(*d.UniqueId); ok {
 		d.State = new(string)
 		*d.State = val
 	}
@@ -176,3 +192,21 @@ func (d *Switch) GetAppState() *State {
 func (d *Switch) SetAppState(appState *State) {
 	d.AppState = appState
 }
+
+func (d *Switch) GetWindow() *StateWindow {
+	return d.Window
+}
+
+func (d *Switch) PublishState() {
+	d.mu.RLock()
+	if d.State == nil {
+		d.mu.RUnlock()
+		return
+	}
+	current := *d.State
+	d.mu.RUnlock()
+
+	d.echo.expect(current)
+	token := d.AppState.Mqtt.Publish(*d.StateTopic, byte(*d.Qos), *d.Retain, current)
+	token.Wait()
+}
@@ -1,18 +1,117 @@
 package domain
 
-import mqtt "github.com/eclipse/paho.mqtt.golang"
+import (
+	"sync"
+	"time"
+)
 
 type CtrlConfig struct {
-	NodeId          string             `json:"id"`
-	MqttHost        string             `json:"mqtt"`
-	ChannelPrefix   string             `json:"channel"`
-	DiscoverChannel string             `json:"homeassistant_discover"`
-	Windows         []CtrlConfigWindow `json:"windows"`
+	NodeId          string              `json:"id"`
+	MqttHost        string              `json:"mqtt"`
+	EmbeddedListen  string              `json:"embedded_listen"`
+	ChannelPrefix   string              `json:"channel"`
+	DiscoverChannel string              `json:"homeassistant_discover"`
+	Windows         []CtrlConfigWindow  `json:"windows"`
+	Groups          []CtrlConfigGroup   `json:"groups"`
+	Audit           CtrlConfigAudit     `json:"audit"`
+	Discovery       CtrlConfigDiscovery `json:"discovery"`
+	Vacation        CtrlConfigVacation  `json:"vacation"`
+	Commands        CtrlConfigCommands  `json:"commands"`
+	Motor           CtrlConfigMotor     `json:"motor"`
+	ContactSensors  CtrlConfigContacts  `json:"contact_sensors"`
+	Location        CtrlConfigLocation  `json:"location"`
+	Climate         CtrlConfigClimate   `json:"climate"`
+	Shading         CtrlConfigShading   `json:"shading"`
+}
+
+// CtrlConfigLocation is where the windows are, to calculate the position of the sun.
+type CtrlConfigLocation struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// CtrlConfigClimate lowers the covers to HeatPosition while a room is warmer than ComfortLimit and the sun shines on
+// the window, and closes them to InsulationPosition at night while it is colder than InsulationBelow outside, or in
+// the room without an outdoor sensor.
+type CtrlConfigClimate struct {
+	OutdoorSensor      string   `json:"outdoor_temperature_sensor"`
+	ComfortLimit       *float64 `json:"comfort_limit"`
+	HeatPosition       *int     `json:"heat_position"`
+	InsulationBelow    *float64 `json:"insulation_below"`
+	InsulationPosition int      `json:"insulation_position"`
+}
+
+// CtrlConfigShading lowers the covers to Position once the illuminance stayed above EnterLux for EnterDelaySeconds
+// while the sun shines on the window, and raises them again once it stayed below ExitLux for ExitDelaySeconds. Either
+// state is held for at least HoldSeconds.
+type CtrlConfigShading struct {
+	IlluminanceSensor string   `json:"illuminance_sensor"`
+	EnterLux          *float64 `json:"enter_lux"`
+	ExitLux           *float64 `json:"exit_lux"`
+	EnterDelaySeconds *int     `json:"enter_delay_seconds"`
+	ExitDelaySeconds  *int     `json:"exit_delay_seconds"`
+	HoldSeconds       *int     `json:"hold_seconds"`
+	Position          *int     `json:"position"`
+	Tilt              *int     `json:"tilt"`
+}
+
+// CtrlConfigContacts tells when a contact sensor is offline or its battery low. FailSafe is the contact assumed while
+// offline: `last` keeps the last state reported, `open` treats the window as open and `closed` as closed.
+type CtrlConfigContacts struct {
+	OfflineAfterMinutes int    `json:"offline_after_minutes"`
+	LowBattery          int    `json:"low_battery"`
+	FailSafe            string `json:"fail_safe"`
+}
+
+// CtrlConfigMotor protects the motors of the output covers. Commands within DebounceMs are coalesced, the motor keeps
+// its direction for at least ReversalDwellMs and more than DailyBudget movements a day raise a warning, 0 disables each.
+type CtrlConfigMotor struct {
+	DebounceMs      int `json:"debounce_ms"`
+	ReversalDwellMs int `json:"reversal_dwell_ms"`
+	DailyBudget     int `json:"daily_budget"`
+}
+
+// CtrlConfigCommands limits the covers moving at the same time, 0 for no limit, and the time between two commands.
+// Commands not reaching their target are retried Retries times, waiting RetryBackoffMs doubled on each attempt.
+type CtrlConfigCommands struct {
+	MaxMoving      int `json:"max_moving"`
+	SpacingMs      int `json:"spacing_ms"`
+	Retries        int `json:"retries"`
+	RetryBackoffMs int `json:"retry_backoff_ms"`
+}
+
+// CtrlConfigVacation holds the periods of the day in which the vacation mode moves the windows.
+type CtrlConfigVacation struct {
+	Periods []CtrlConfigVacationPeriod `json:"periods"`
+}
+
+// CtrlConfigVacationPeriod moves each window once a day, at a random time between From and To (`15:04`), to a random
+// position between Min and Max.
+type CtrlConfigVacationPeriod struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Min  int    `json:"min"`
+	Max  int    `json:"max"`
+}
+
+type CtrlConfigDiscovery struct {
+	IntervalMs   int `json:"interval_ms"`
+	StateDelayMs int `json:"state_delay_ms"`
+}
+
+type CtrlConfigAudit struct {
+	Size      int    `json:"size"`
+	File      string `json:"file"`
+	MaxSizeKb int    `json:"max_size_kb"`
+	MaxFiles  int    `json:"max_files"`
 }
 type CtrlConfigWindow struct {
 	Id                     string `json:"id"`
+	Area                   string `json:"area"`
 	TiltedSensorStateTopic string `json:"window_tilted_sensor"`
 	WindowSensorStateTopic string `json:"window_open_sensor"`
+	TiltedSensorDebounceMs int    `json:"window_tilted_sensor_debounce_ms"`
+	WindowSensorDebounceMs int    `json:"window_open_sensor_debounce_ms"`
 	OutputCoverStateTopic  string `json:"cover_output"`
 	OutputCoverTimeUp      int    `json:"cover_output_calibration_time_up"`
 	OutputCoverTimeDown    int    `json:"cover_output_calibration_time_down"`
@@ -21,6 +120,42 @@ type CtrlConfigWindow struct {
 	TiltedAndDrizzle       int    `json:"tilted_drizzle"`
 	TiltedAndStorm         int    `json:"tilted_storm"`
 	TiltedAndClosed        int    `json:"tilted_closed"`
+	Lockout                bool   `json:"lockout"`
+	Tilt                   bool   `json:"tilt"`
+	RainTilt               *int   `json:"tilt_rain"`
+	// OutputCovers are further motors of the window moving together with the output cover
+	OutputCovers []CtrlConfigCover `json:"cover_outputs"`
+	// TemperatureSensor is the temperature sensor of the room, Facade the azimuth the window faces
+	TemperatureSensor string   `json:"temperature_sensor"`
+	Facade            *float64 `json:"facade"`
+	// IlluminanceSensor and ShadingPosition replace the shading configuration of the controller for this window
+	IlluminanceSensor string `json:"illuminance_sensor"`
+	ShadingPosition   *int   `json:"shading_position"`
+}
+
+// CtrlConfigCover is an output cover with its own calibration times.
+type CtrlConfigCover struct {
+	StateTopic string `json:"cover_output"`
+	TimeUp     int    `json:"cover_output_calibration_time_up"`
+	TimeDown   int    `json:"cover_output_calibration_time_down"`
+}
+
+// CoverOutputs returns all output covers of the window, the output cover first.
+func (w *CtrlConfigWindow) CoverOutputs() []CtrlConfigCover {
+	covers := []CtrlConfigCover{{StateTopic: w.OutputCoverStateTopic, TimeUp: w.OutputCoverTimeUp, TimeDown: w.OutputCoverTimeDown}}
+	return append(covers, w.OutputCovers...)
+}
+
+// CtrlConfigGroup combines windows, e.g. of a room or facade. Rain thresholds set for the group replace the
+// thresholds of its windows.
+type CtrlConfigGroup struct {
+	Id               string   `json:"id"`
+	Area             string   `json:"area"`
+	Windows          []string `json:"windows"`
+	OpenAndDrizzle   *int     `json:"open_drizzle"`
+	OpenAndStorm     *int     `json:"open_storm"`
+	TiltedAndDrizzle *int     `json:"tilted_drizzle"`
+	TiltedAndStorm   *int     `json:"tilted_storm"`
 }
 
 type CtrlState struct {
@@ -28,12 +163,22 @@ type CtrlState struct {
 }
 
 type State struct {
-	Mqtt          *mqtt.Client
+	Mqtt          MqttClient
 	Configuration *CtrlConfig
 	RainInput     *Select
-	Windows       []StateWindow
+	Recalculate   *Button
+	Automation    *Switch
+	Vacation      *Switch
+	Heat          *Switch
+	Insulation    *Switch
+	Windows       []*StateWindow
+	Groups        []*StateGroup
 	Topics        map[string]*StateWindow
 	States        map[string]string
+	Discovery     *DiscoveryQueue
+	Commands      *CommandScheduler
+	discovery     map[string]Entity
+	mu            sync.RWMutex
 }
 
 type StateWindow struct {
@@ -42,6 +187,8 @@ type StateWindow struct {
 	Automation              *Switch
 	ScheduledInputCover     *Cover
 	ScheduledValue          *Sensor
+	ShadingValue            *Sensor
+	VacationValue           *Sensor
 	WindowTiltedInputSensor *BinarySensor
 	WindowOpenInputSensor   *BinarySensor
 	WindowOpenValue         *Sensor
@@ -49,11 +196,108 @@ type StateWindow struct {
 	ManualInputCover        *Cover
 	ManualValue             *Sensor
 	RainValue               *Sensor
+	HeatValue               *Sensor
+	InsulationValue         *Sensor
+	RoomTemperature         *float64
+	ScheduledTiltValue      *Sensor
+	ShadingTiltValue        *Sensor
+	RainTiltValue           *Sensor
+	ManualTiltValue         *Sensor
+	OutputTiltValue         *Sensor
 	OutputValue             *Sensor
 	OutputCover             *Cover
+	OutputCovers            []*Cover
+	CoverCommands           []string
+	OutputSeq               int
 	Calibrating             *Sensor
+	OpenAndDrizzle          *Number
+	OpenAndStorm            *Number
+	TiltedAndDrizzle        *Number
+	TiltedAndStorm          *Number
+	TiltedAndClosed         *Number
+	CalibrateButton         *Button
+	ResetManualButton       *Button
+	StopButton              *Button
+	ResyncButton            *Button
+	Stuck                   *BinarySensor
+	Ack                     *CommandAck
+	MotorBudget             *BinarySensor
+	ContactInconsistent     *BinarySensor
+	OpenSensorOffline       *BinarySensor
+	OpenSensorLowBattery    *BinarySensor
+	TiltedSensorOffline     *BinarySensor
+	TiltedSensorLowBattery  *BinarySensor
+	Motor                   MotorProtection
+	Shading                 ShadingState
+	Decisions               *DecisionLog
+	Groups                  []*StateGroup
+	events                  chan func()
+	done                    chan struct{}
+	stopped                 chan struct{}
+}
+
+// CommandAck tracks the last command sent to the output cover of a window until the cover reaches its target. The
+// timer is armed by the scheduler once the command is sent, the other fields are only accessed on the event loop of
+// the window.
+type CommandAck struct {
+	Command  string
+	Target   int
+	Targets  []int
+	Priority int
+	Attempt  int
+	Timeout  time.Duration
+	timer    *time.Timer
+	stopped  bool
+	mu       sync.Mutex
+}
+
+// MotorProtection holds the movements of the output cover of a window and the command held back to protect its
+// motor. Only accessed on the event loop of the window.
+type MotorProtection struct {
+	Direction       int
+	LastMove        time.Time
+	Day             string
+	Moves           int
+	PendingCommand  string
+	PendingTarget   int
+	PendingPriority int
+	PendingAck      *CommandAck
+	Pending         bool
+	Timer           *time.Timer
+	Seq             int
+}
+
+// ShadingState is the brightness hysteresis of a window. Crossed is when the illuminance crossed the threshold
+// towards the other state, Since when the state last changed. Only accessed on the event loop of the window.
+type ShadingState struct {
+	Illuminance *float64
+	Active      bool
+	Since       time.Time
+	Crossed     time.Time
+	Timer       *time.Timer
+	Seq         int
+}
+
+// StateGroup holds the entities of a window group. They are shared by all windows of the group, so the state
+// aggregated from the windows is guarded by a lock.
+type StateGroup struct {
+	Id               string
+	Config           *CtrlConfigGroup
+	Windows          []*StateWindow
+	Cover            *Cover
+	Automation       *Switch
+	OpenAndDrizzle   *Number
+	OpenAndStorm     *Number
+	TiltedAndDrizzle *Number
+	TiltedAndStorm   *Number
+	positions        map[string]int
+	automation       map[string]bool
+	mu               sync.Mutex
 }
 
 type AqaraDoorSensorState struct {
-	Contact bool `json:"contact"`
+	Contact     bool `json:"contact"`
+	Battery     *int `json:"battery"`
+	LinkQuality *int `json:"linkquality"`
+	Voltage     *int `json:"voltage"`
 }
@@ -0,0 +1,59 @@
+package domain
+
+const windowEventBuffer = 256
+
+// Start runs the event loop of the window. All handlers touching the window and its entities are serialized
+// through this loop, so MQTT callbacks arriving concurrently never mutate the window at the same time.
+func (w *StateWindow) Start() {
+	w.events = make(chan func(), windowEventBuffer)
+	w.done = make(chan struct{})
+	w.stopped = make(chan struct{})
+	go func() {
+		defer close(w.stopped)
+		for {
+			select {
+			case fn := <-w.events:
+				fn()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the event loop and waits for the currently running handler to finish.
+func (w *StateWindow) Stop() {
+	if w.done != nil {
+		close(w.done)
+		<-w.stopped
+	}
+}
+
+// Dispatch queues fn on the event loop of the window. Without a window or a running loop fn is executed immediately.
+func (w *StateWindow) Dispatch(fn func()) {
+	if w == nil || w.events == nil {
+		fn()
+		return
+	}
+	select {
+	case w.events <- fn:
+	case <-w.done:
+	}
+}
+
+// Sync runs fn on the event loop of the window and waits for it to finish. Must not be called from within the loop.
+func (w *StateWindow) Sync(fn func()) {
+	if w == nil || w.events == nil {
+		fn()
+		return
+	}
+	finished := make(chan struct{})
+	w.Dispatch(func() {
+		fn()
+		close(finished)
+	})
+	select {
+	case <-finished:
+	case <-w.done:
+	}
+}
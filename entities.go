@@ -2,21 +2,45 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"shutter_control/common"
 	"shutter_control/domain"
 	"strconv"
 	"strings"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 func initEntities() {
 	state.Topics = make(map[string]*domain.StateWindow)
+	newControllerEntities()
+	applyGroupThresholds()
+	initWindows()
+	initGroups()
+
+	// Subscribe last, rain changes fan out to all windows
+	state.RainInput.Subscribe()
+	state.Recalculate.Subscribe()
+	state.Automation.Subscribe()
+	state.Vacation.Subscribe()
+	state.Heat.Subscribe()
+	state.Insulation.Subscribe()
+	subscribeTemperatures()
+	subscribeIlluminance()
+	subscribeControl()
+	subscribeHomeassistantStatus()
+}
+
+// newControllerEntities creates and initializes the entities of the controller device, without subscribing them.
+func newControllerEntities() {
 	device := domain.Device{
 		Identifiers:  state.Configuration.NodeId,
 		Manufacturer: domain.Manufacturer,
 		Model:        domain.SoftwareName,
 		Name:         domain.InstanceName,
+		SwVersion:    domain.SoftwareVersion,
 	}
 
 	rainInputValues := []string{domain.RainNone, domain.RainDrizzle, domain.RainStorm}
@@ -31,189 +55,520 @@ func initEntities() {
 
 	state.RainInput = &rainInput
 	state.RainInput.Initialize()
-	state.RainInput.Subscribe()
 
-	initWindows()
+	state.Recalculate = &domain.Button{
+		Device:         &device,
+		Name:           String("recalculate_all"),
+		CommandFunc:    recalculateAllButton,
+		AppState:       &state,
+		Icon:           String("mdi:calculator"),
+		EntityCategory: &domain.EntityCategoryConfig,
+	}
+	state.Recalculate.Initialize()
+
+	state.Automation = &domain.Switch{
+		Device:      &device,
+		Name:        String("master_automation"),
+		CommandFunc: masterAutomationSwitch,
+		AppState:    &state,
+		Icon:        String("mdi:robot"),
+	}
+	state.Automation.Initialize()
+
+	state.Vacation = &domain.Switch{
+		Device:      &device,
+		Name:        String("vacation_mode"),
+		CommandFunc: vacationSwitch,
+		AppState:    &state,
+		Icon:        String("mdi:airplane"),
+		State:       String("OFF"),
+	}
+	state.Vacation.Initialize()
+
+	state.Heat = &domain.Switch{
+		Device:      &device,
+		Name:        String("heat_protection"),
+		CommandFunc: heatSwitch,
+		AppState:    &state,
+		Icon:        String("mdi:sun-thermometer"),
+		State:       String("OFF"),
+	}
+	state.Heat.Initialize()
+
+	state.Insulation = &domain.Switch{
+		Device:      &device,
+		Name:        String("winter_insulation"),
+		CommandFunc: insulationSwitch,
+		AppState:    &state,
+		Icon:        String("mdi:snowflake-thermometer"),
+		State:       String("OFF"),
+	}
+	state.Insulation.Initialize()
 }
 
 func initWindows() {
-	state.Windows = make([]domain.StateWindow, 0)
-	for i, w := range state.Configuration.Windows {
-		window := domain.Device{
-			Identifiers:  state.Configuration.NodeId + "_" + w.Id,
-			Manufacturer: domain.Manufacturer,
-			Model:        domain.WindowName,
-			Name:         "window_" + w.Id,
-		}
+	state.Windows = make([]*domain.StateWindow, 0)
+	for i := range state.Configuration.Windows {
+		sw := newStateWindow(&state.Configuration.Windows[i])
 
-		var scheduledValue = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_scheduled_value"),
-			AppState: &state,
-		}
-		var windowOpenValue = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_window_open_value"),
-			AppState: &state,
-		}
-		var windowOpenState = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_window_open_state"),
-			AppState: &state,
-		}
-		var manualValue = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_manual_value"),
-			AppState: &state,
-		}
-		var rainValue = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_rain_value"),
-			AppState: &state,
-		}
-		var outputValue = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_automation_output"),
-			AppState: &state,
-		}
+		// Subscribe within the event loop, so retained messages arriving while subscribing queue up behind it
+		sw.Start()
+		sw.Sync(func() {
+			subscribeWindow(sw)
+		})
 
-		var automation = domain.Switch{
-			Device:           &window,
-			Name:             String(w.Id + "_window_automation"),
-			CommandFunc:      windowAutomationSwitch,
-			AppState:         &state,
-			StateUpdatedFunc: &windowAutomationSwitchHandle,
-		}
-		var manualCover = domain.Cover{
-			Device:              &window,
-			Name:                String(w.Id + "_manual_cover"),
-			CommandFunc:         windowManualCover,
-			AppState:            &state,
-			StateTopic:          &w.OutputCoverStateTopic,
-			PositionTopic:       &w.OutputCoverStateTopic,
-			JsonAttributesTopic: &w.OutputCoverStateTopic,
-		}
-		var scheduledCover = domain.Cover{
-			Device:           &window,
-			Name:             String(w.Id + "_scheduled_cover"),
-			CommandFunc:      windowScheduledInput,
-			AppState:         &state,
-			StateUpdatedFunc: &scheduledCoverHandler,
-		}
+		state.Windows = append(state.Windows, sw)
+	}
+}
 
-		var windowOpenSensor *domain.BinarySensor
-		if w.WindowSensorStateTopic != "" {
-			windowOpenSensor = &domain.BinarySensor{
-				Name:             String(w.Id + "_window_open"),
-				StateTopic:       &w.WindowSensorStateTopic,
-				StateUpdatedFunc: &windowOpenHandler,
-				AppState:         &state,
-			}
-		}
+// newStateWindow creates and initializes all entities of a window, without subscribing them.
+func newStateWindow(w *domain.CtrlConfigWindow) *domain.StateWindow {
+	window := domain.Device{
+		Identifiers:   state.Configuration.NodeId + "_" + w.Id,
+		Manufacturer:  domain.Manufacturer,
+		Model:         domain.WindowName,
+		Name:          "window_" + w.Id,
+		SuggestedArea: w.Area,
+		SwVersion:     domain.SoftwareVersion,
+		ViaDevice:     state.Configuration.NodeId,
+	}
 
-		var windowTiltedSensor *domain.BinarySensor
-		if w.TiltedSensorStateTopic != "" {
-			windowTiltedSensor = &domain.BinarySensor{
-				Name:             String(w.Id + "_window_tilted"),
-				StateTopic:       &w.TiltedSensorStateTopic,
-				StateUpdatedFunc: &windowTiltedHandler,
-				AppState:         &state,
-			}
-		}
+	var scheduledValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_scheduled_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var shadingValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_shading_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var vacationValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_vacation_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var windowOpenValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_window_open_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	// 0 closed, 1 tilted, 2 open
+	var windowOpenState = domain.Sensor{
+		Device:         &window,
+		Name:           String(w.Id + "_window_open_state"),
+		AppState:       &state,
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		DeviceClass:    &domain.DeviceClassEnum,
+		Options:        &[]string{"0", "1", "2"},
+	}
+	var manualValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_manual_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var rainValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_rain_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var heatValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_heat_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var insulationValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_insulation_value"),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+	var outputValue = domain.Sensor{
+		Device:            &window,
+		Name:              String(w.Id + "_automation_output"),
+		AppState:          &state,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
 
-		var outputCover = domain.Cover{
-			Device:           &window,
-			Name:             String(w.Id + "_output_cover"),
+	var automation = domain.Switch{
+		Device:           &window,
+		Name:             String(w.Id + "_window_automation"),
+		CommandFunc:      windowAutomationSwitch,
+		AppState:         &state,
+		StateUpdatedFunc: &windowAutomationSwitchHandle,
+	}
+	var manualCover = domain.Cover{
+		Device:              &window,
+		Name:                String(w.Id + "_manual_cover"),
+		CommandFunc:         windowManualCover,
+		AppState:            &state,
+		StateTopic:          &w.OutputCoverStateTopic,
+		PositionTopic:       &w.OutputCoverStateTopic,
+		JsonAttributesTopic: &w.OutputCoverStateTopic,
+	}
+	var scheduledCover = domain.Cover{
+		Device:           &window,
+		Name:             String(w.Id + "_scheduled_cover"),
+		CommandFunc:      windowScheduledInput,
+		AppState:         &state,
+		StateUpdatedFunc: &scheduledCoverHandler,
+	}
+
+	// Venetian blinds have separate layers for the tilt of the slats
+	var scheduledTiltValue, shadingTiltValue, rainTiltValue, manualTiltValue, outputTiltValue *domain.Sensor
+	if w.Tilt {
+		scheduledTiltValue = newTiltSensor(&window, w.Id+"_scheduled_tilt_value")
+		shadingTiltValue = newTiltSensor(&window, w.Id+"_shading_tilt_value")
+		rainTiltValue = newTiltSensor(&window, w.Id+"_rain_tilt_value")
+		manualTiltValue = newTiltSensor(&window, w.Id+"_manual_tilt_value")
+		outputTiltValue = newTiltSensor(&window, w.Id+"_automation_output_tilt")
+		outputTiltValue.EntityCategory = nil
+		manualCover.TiltCommandFunc = windowManualTilt
+		scheduledCover.TiltCommandFunc = windowScheduledTilt
+	}
+
+	var windowOpenSensor, openSensorOffline, openSensorLowBattery *domain.BinarySensor
+	if w.WindowSensorStateTopic != "" {
+		openSensorOffline, openSensorLowBattery = newContactHealthSensors(&window, w.Id+"_window_open_sensor")
+		windowOpenSensor = &domain.BinarySensor{
+			Name:             String(w.Id + "_window_open"),
+			StateTopic:       &w.WindowSensorStateTopic,
+			StateUpdatedFunc: &windowOpenHandler,
 			AppState:         &state,
-			StateTopic:       &w.OutputCoverStateTopic,
-			CommandTopic:     String(w.OutputCoverStateTopic + "/set"),
-			StateUpdatedFunc: &outputCoverHandler,
+			Debounce:         time.Duration(w.WindowSensorDebounceMs) * time.Millisecond,
+			MaxDebounce:      contactMaxDebounce * time.Duration(w.WindowSensorDebounceMs) * time.Millisecond,
+			Immediate:        contactOpening,
 		}
+	}
 
-		var calibratingSensor = domain.Sensor{
-			Device:   &window,
-			Name:     String(w.Id + "_calibrating"),
-			AppState: &state,
+	var windowTiltedSensor, tiltedSensorOffline, tiltedSensorLowBattery *domain.BinarySensor
+	if w.TiltedSensorStateTopic != "" {
+		tiltedSensorOffline, tiltedSensorLowBattery = newContactHealthSensors(&window, w.Id+"_window_tilted_sensor")
+		windowTiltedSensor = &domain.BinarySensor{
+			Name:             String(w.Id + "_window_tilted"),
+			StateTopic:       &w.TiltedSensorStateTopic,
+			StateUpdatedFunc: &windowTiltedHandler,
+			AppState:         &state,
+			Debounce:         time.Duration(w.TiltedSensorDebounceMs) * time.Millisecond,
+			MaxDebounce:      contactMaxDebounce * time.Duration(w.TiltedSensorDebounceMs) * time.Millisecond,
+			Immediate:        contactOpening,
 		}
+	}
 
-		sw := domain.StateWindow{
-			Id:                      w.Id,
-			Config:                  &state.Configuration.Windows[i],
-			Automation:              &automation,
-			ScheduledInputCover:     &scheduledCover,
-			ScheduledValue:          &scheduledValue,
-			ManualInputCover:        &manualCover,
-			WindowOpenInputSensor:   windowOpenSensor,
-			WindowTiltedInputSensor: windowTiltedSensor,
-			WindowOpenValue:         &windowOpenValue,
-			WindowOpenState:         &windowOpenState,
-			ManualValue:             &manualValue,
-			OutputValue:             &outputValue,
-			OutputCover:             &outputCover,
-			RainValue:               &rainValue,
-			Calibrating:             &calibratingSensor,
-		}
-		automation.Window = &sw
-		scheduledCover.Window = &sw
-		scheduledValue.Window = &sw
-		manualCover.Window = &sw
-		windowOpenValue.Window = &sw
-		windowOpenState.Window = &sw
-		manualValue.Window = &sw
-		outputValue.Window = &sw
-		outputCover.Window = &sw
-		rainValue.Window = &sw
-		calibratingSensor.Window = &sw
-		if windowOpenSensor != nil {
-			windowOpenSensor.Window = &sw
-			windowOpenSensor.Initialize()
-			windowOpenSensor.Subscribe()
-		}
-		if windowTiltedSensor != nil {
-			windowTiltedSensor.Window = &sw
-			windowTiltedSensor.Initialize()
-			windowTiltedSensor.Subscribe()
-		}
+	var outputCover = domain.Cover{
+		Device:           &window,
+		Name:             String(w.Id + "_output_cover"),
+		AppState:         &state,
+		StateTopic:       &w.OutputCoverStateTopic,
+		CommandTopic:     String(w.OutputCoverStateTopic + "/set"),
+		StateUpdatedFunc: &outputCoverHandler,
+	}
 
-		automation.Initialize()
-		automation.Subscribe()
+	outputCovers := []*domain.Cover{&outputCover}
+	for i := range w.OutputCovers {
+		outputCovers = append(outputCovers, newOutputCover(&window, fmt.Sprintf("%s_output_cover_%d", w.Id, i+2), &w.OutputCovers[i]))
+	}
 
-		scheduledCover.Initialize(true)
-		scheduledCover.Subscribe()
+	var calibratingSensor = domain.Sensor{
+		Device:         &window,
+		Name:           String(w.Id + "_calibrating"),
+		AppState:       &state,
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		DeviceClass:    &domain.DeviceClassEnum,
+		Options:        &[]string{"0", "1"},
+	}
 
-		scheduledValue.Initialize()
-		scheduledValue.Subscribe()
+	var stuckSensor = domain.BinarySensor{
+		Device:         &window,
+		Name:           String(w.Id + "_stuck"),
+		AppState:       &state,
+		DeviceClass:    String("problem"),
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		State:          String("OFF"),
+	}
 
-		manualCover.Initialize(true)
-		manualCover.Subscribe()
+	var motorBudgetSensor = domain.BinarySensor{
+		Device:         &window,
+		Name:           String(w.Id + "_motor_budget_exceeded"),
+		AppState:       &state,
+		DeviceClass:    String("problem"),
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		State:          String("OFF"),
+	}
 
-		manualValue.Initialize()
-		manualValue.Subscribe()
+	var contactInconsistentSensor = domain.BinarySensor{
+		Device:         &window,
+		Name:           String(w.Id + "_contact_inconsistent"),
+		AppState:       &state,
+		DeviceClass:    String("problem"),
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		State:          String("OFF"),
+	}
 
-		windowOpenValue.Initialize()
-		windowOpenValue.Subscribe()
+	openAndDrizzle := newThresholdNumber(&window, w.Id+"_open_drizzle", w.OpenAndDrizzle)
+	openAndStorm := newThresholdNumber(&window, w.Id+"_open_storm", w.OpenAndStorm)
+	tiltedAndDrizzle := newThresholdNumber(&window, w.Id+"_tilted_drizzle", w.TiltedAndDrizzle)
+	tiltedAndStorm := newThresholdNumber(&window, w.Id+"_tilted_storm", w.TiltedAndStorm)
+	tiltedAndClosed := newThresholdNumber(&window, w.Id+"_tilted_closed", w.TiltedAndClosed)
+
+	calibrateButton := newWindowButton(&window, w.Id+"_calibrate", "mdi:arrow-expand-up", calibrateCommand)
+	calibrateButton.EntityCategory = &domain.EntityCategoryConfig
+	resetManualButton := newWindowButton(&window, w.Id+"_reset_manual", "mdi:restore", resetManualCommand)
+	stopButton := newWindowButton(&window, w.Id+"_stop", "mdi:stop", stopCommand)
+	resyncButton := newWindowButton(&window, w.Id+"_resync", "mdi:sync", resyncCommand)
+	resyncButton.EntityCategory = &domain.EntityCategoryConfig
+
+	sw := &domain.StateWindow{
+		Id:                      w.Id,
+		Config:                  w,
+		Automation:              &automation,
+		ScheduledInputCover:     &scheduledCover,
+		ScheduledValue:          &scheduledValue,
+		ShadingValue:            &shadingValue,
+		VacationValue:           &vacationValue,
+		ManualInputCover:        &manualCover,
+		WindowOpenInputSensor:   windowOpenSensor,
+		WindowTiltedInputSensor: windowTiltedSensor,
+		WindowOpenValue:         &windowOpenValue,
+		WindowOpenState:         &windowOpenState,
+		ManualValue:             &manualValue,
+		OutputValue:             &outputValue,
+		OutputCover:             &outputCover,
+		OutputCovers:            outputCovers,
+		RainValue:               &rainValue,
+		HeatValue:               &heatValue,
+		InsulationValue:         &insulationValue,
+		ScheduledTiltValue:      scheduledTiltValue,
+		ShadingTiltValue:        shadingTiltValue,
+		RainTiltValue:           rainTiltValue,
+		ManualTiltValue:         manualTiltValue,
+		OutputTiltValue:         outputTiltValue,
+		Calibrating:             &calibratingSensor,
+		OpenAndDrizzle:          openAndDrizzle,
+		OpenAndStorm:            openAndStorm,
+		TiltedAndDrizzle:        tiltedAndDrizzle,
+		TiltedAndStorm:          tiltedAndStorm,
+		TiltedAndClosed:         tiltedAndClosed,
+		CalibrateButton:         calibrateButton,
+		ResetManualButton:       resetManualButton,
+		StopButton:              stopButton,
+		ResyncButton:            resyncButton,
+		Stuck:                   &stuckSensor,
+		MotorBudget:             &motorBudgetSensor,
+		ContactInconsistent:     &contactInconsistentSensor,
+		OpenSensorOffline:       openSensorOffline,
+		OpenSensorLowBattery:    openSensorLowBattery,
+		TiltedSensorOffline:     tiltedSensorOffline,
+		TiltedSensorLowBattery:  tiltedSensorLowBattery,
+		Decisions:               domain.NewDecisionLog(auditSize()),
+	}
+	automation.Window = sw
+	scheduledCover.Window = sw
+	scheduledValue.Window = sw
+	shadingValue.Window = sw
+	vacationValue.Window = sw
+	manualCover.Window = sw
+	windowOpenValue.Window = sw
+	windowOpenState.Window = sw
+	manualValue.Window = sw
+	outputValue.Window = sw
+	for _, c := range outputCovers {
+		c.Window = sw
+	}
+	rainValue.Window = sw
+	heatValue.Window = sw
+	insulationValue.Window = sw
+	calibratingSensor.Window = sw
+	stuckSensor.Window = sw
+	motorBudgetSensor.Window = sw
+	contactInconsistentSensor.Window = sw
+	if windowOpenSensor != nil {
+		windowOpenSensor.Window = sw
+	}
+	if windowTiltedSensor != nil {
+		windowTiltedSensor.Window = sw
+	}
 
-		windowOpenState.Initialize()
-		windowOpenState.Subscribe()
+	if windowOpenSensor != nil {
+		windowOpenSensor.Initialize()
+	}
+	if windowTiltedSensor != nil {
+		windowTiltedSensor.Initialize()
+	}
+	automation.Initialize()
+	scheduledCover.Initialize(true)
+	scheduledValue.Initialize()
+	shadingValue.Initialize()
+	vacationValue.Initialize()
+	manualCover.Initialize(true)
+	manualValue.Initialize()
+	windowOpenValue.Initialize()
+	windowOpenState.Initialize()
+	outputValue.Initialize()
+	outputValue.JsonAttributesTopic = String(domain.GetTopic(&outputValue, "json_attributes_topic"))
+	for _, c := range outputCovers {
+		c.Initialize(true)
+	}
+	rainValue.Initialize()
+	heatValue.Initialize()
+	insulationValue.Initialize()
+	calibratingSensor.Initialize()
+	stuckSensor.Initialize()
+	motorBudgetSensor.Initialize()
+	contactInconsistentSensor.Initialize()
+	for _, s := range contactHealthSensors(sw) {
+		s.Window = sw
+		s.Initialize()
+	}
+	for _, s := range tiltSensors(sw) {
+		s.Window = sw
+		s.Initialize()
+	}
+	for _, n := range windowThresholds(sw) {
+		n.Window = sw
+		n.Initialize()
+	}
+	for _, b := range windowButtons(sw) {
+		b.Window = sw
+		b.Initialize()
+	}
 
-		outputValue.Initialize()
-		outputValue.Subscribe()
+	return sw
+}
 
-		outputCover.Initialize(true)
-		outputCover.Subscribe()
+// newThresholdNumber creates a number entity for a rain or tilted threshold of a window, the configured value is the
+// default until changed in Homeassistant.
+func newThresholdNumber(device *domain.Device, name string, value int) *domain.Number {
+	return &domain.Number{
+		Device:            device,
+		Name:              String(name),
+		CommandFunc:       windowThresholdCommand,
+		AppState:          &state,
+		StateUpdatedFunc:  &windowThresholdHandler,
+		State:             String(strconv.Itoa(value)),
+		Min:               Float(0),
+		Max:               Float(100),
+		Step:              Float(1),
+		UnitOfMeasurement: &domain.UnitPercent,
+		EntityCategory:    &domain.EntityCategoryConfig,
+	}
+}
 
-		rainValue.Initialize()
-		rainValue.Subscribe()
+// newWindowButton creates a button running action on the event loop of the window when pressed.
+func newWindowButton(device *domain.Device, name string, icon string, action func(window *domain.StateWindow)) *domain.Button {
+	return &domain.Button{
+		Device:   device,
+		Name:     String(name),
+		AppState: &state,
+		Icon:     String(icon),
+		CommandFunc: func(client mqtt.Client, msg mqtt.Message) {
+			window := state.WindowForTopic(msg.Topic())
+			window.Dispatch(func() {
+				action(window)
+			})
+		},
+	}
+}
 
-		calibratingSensor.Initialize()
-		calibratingSensor.Subscribe()
+func windowButtons(sw *domain.StateWindow) []*domain.Button {
+	return []*domain.Button{sw.CalibrateButton, sw.ResetManualButton, sw.StopButton, sw.ResyncButton}
+}
 
-		// Always unset calibrating on startup
-		calibratingValueS := strconv.Itoa(0)
-		calibratingSensor.UpdateState(&calibratingValueS)
+func windowThresholds(sw *domain.StateWindow) []*domain.Number {
+	return []*domain.Number{sw.OpenAndDrizzle, sw.OpenAndStorm, sw.TiltedAndDrizzle, sw.TiltedAndStorm, sw.TiltedAndClosed}
+}
 
-		state.Windows = append(state.Windows, sw)
+// contactHealthSensors returns the offline and low battery sensors of the contact sensors present.
+func contactHealthSensors(sw *domain.StateWindow) []*domain.BinarySensor {
+	sensors := make([]*domain.BinarySensor, 0)
+	if sw.WindowOpenInputSensor != nil {
+		sensors = append(sensors, sw.OpenSensorOffline, sw.OpenSensorLowBattery)
 	}
+	if sw.WindowTiltedInputSensor != nil {
+		sensors = append(sensors, sw.TiltedSensorOffline, sw.TiltedSensorLowBattery)
+	}
+	return sensors
+}
+
+func subscribeWindow(sw *domain.StateWindow) {
+	// Sensors not reporting are offline after the grace period from now
+	if sw.WindowOpenInputSensor != nil {
+		sw.WindowOpenInputSensor.LastSeen = time.Now()
+		sw.WindowOpenInputSensor.Subscribe()
+	}
+	if sw.WindowTiltedInputSensor != nil {
+		sw.WindowTiltedInputSensor.LastSeen = time.Now()
+		sw.WindowTiltedInputSensor.Subscribe()
+	}
+	sw.Automation.Subscribe()
+	sw.ScheduledInputCover.Subscribe()
+	sw.ScheduledValue.Subscribe()
+	sw.ShadingValue.Subscribe()
+	sw.VacationValue.Subscribe()
+	sw.ManualInputCover.Subscribe()
+	sw.ManualValue.Subscribe()
+	sw.WindowOpenValue.Subscribe()
+	sw.WindowOpenState.Subscribe()
+	sw.OutputValue.Subscribe()
+	for _, c := range sw.OutputCovers {
+		c.Subscribe()
+	}
+	sw.RainValue.Subscribe()
+	sw.HeatValue.Subscribe()
+	sw.InsulationValue.Subscribe()
+	sw.Calibrating.Subscribe()
+	sw.Stuck.Subscribe()
+	sw.MotorBudget.Subscribe()
+	sw.ContactInconsistent.Subscribe()
+	for _, s := range contactHealthSensors(sw) {
+		s.Subscribe()
+	}
+	for _, s := range tiltSensors(sw) {
+		s.Subscribe()
+	}
+	for _, n := range windowThresholds(sw) {
+		n.Subscribe()
+	}
+	for _, b := range windowButtons(sw) {
+		b.Subscribe()
+	}
+
+	// Always unset calibrating on startup
+	calibratingValueS := strconv.Itoa(0)
+	sw.Calibrating.UpdateState(&calibratingValueS)
 }
 
 var windowOpenHandler = func(sensor *domain.BinarySensor, oldState *string, newState *string) {
@@ -241,9 +596,11 @@ var windowTiltedHandler = func(sensor *domain.BinarySensor, oldState *string, ne
 }
 
 var windowAutomationSwitch mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	window := state.Topics[msg.Topic()]
+	window := state.WindowForTopic(msg.Topic())
 	value := string(msg.Payload())
-	window.Automation.UpdateState(&value)
+	window.Dispatch(func() {
+		window.Automation.UpdateState(&value)
+	})
 }
 
 type CoverStateAndPosition struct {
@@ -252,8 +609,14 @@ type CoverStateAndPosition struct {
 }
 
 var windowManualCover mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	window := state.Topics[msg.Topic()]
+	window := state.WindowForTopic(msg.Topic())
 	value := string(msg.Payload())
+	window.Dispatch(func() {
+		manualCoverCommand(window, value)
+	})
+}
+
+func manualCoverCommand(window *domain.StateWindow, value string) {
 
 	if value == "OPEN" {
 		manualCoverStateChanged(window.ManualInputCover, 100)
@@ -272,8 +635,14 @@ var windowManualCover mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 }
 
 var windowScheduledInput mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	window := state.Topics[msg.Topic()]
+	window := state.WindowForTopic(msg.Topic())
 	value := string(msg.Payload())
+	window.Dispatch(func() {
+		scheduledCoverCommand(window, value)
+	})
+}
+
+func scheduledCoverCommand(window *domain.StateWindow, value string) {
 
 	if value == "OPEN" {
 		s := CoverStateAndPosition{
@@ -289,14 +658,46 @@ var windowScheduledInput mqtt.MessageHandler = func(client mqtt.Client, msg mqtt
 		}
 		j, _ := json.Marshal(s)
 		window.ScheduledInputCover.UpdateState(String(string(j)))
+	} else if position, err := strconv.Atoi(value); err == nil {
+		j, _ := json.Marshal(CoverStateAndPosition{Position: Int(position)})
+		window.ScheduledInputCover.UpdateState(String(string(j)))
 	} else {
 		window.ScheduledInputCover.UpdateState(&value)
 	}
 }
 
+var windowThresholdCommand mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	window := state.WindowForTopic(msg.Topic())
+	topic := msg.Topic()
+	value := string(msg.Payload())
+	window.Dispatch(func() {
+		for _, n := range windowThresholds(window) {
+			if *n.CommandTopic == topic {
+				thresholdCommand(n, value)
+			}
+		}
+	})
+}
+
+// thresholdCommand sets a threshold, values out of range are ignored and false is returned.
+func thresholdCommand(number *domain.Number, value string) bool {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < *number.Min || f > *number.Max {
+		common.LogWarning(fmt.Sprintf("Ignoring invalid value %s for %s", value, *number.UniqueId))
+		return false
+	}
+	number.UpdateState(String(strconv.Itoa(int(math.Round(f)))))
+	return true
+}
+
+var windowThresholdHandler = func(number *domain.Number, oldState *string, newState *string) {
+	thresholdChanged(number, newState)
+}
+
 var windowAutomationSwitchHandle = func(switchObj *domain.Switch, oldState *string, newState *string) {
 
 	automationSwitchStateChanged(switchObj, newState)
+	updateGroups(switchObj.Window)
 }
 
 var scheduledCoverHandler = func(cover *domain.Cover, oldState *string, newState *string) {
@@ -315,24 +716,32 @@ var outputCoverHandler = func(cover *domain.Cover, oldState *string, newState *s
 	json.Unmarshal([]byte(*oldState), &os)
 
 	outputCoverStateChanged(cover, &ns, &os)
+	checkAck(cover.Window)
+	updateGroups(cover.Window)
+}
+
+var recalculateAllButton mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	recalculateAll()
 }
 
 var rainInputHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	value := string(msg.Payload())
+	rainCommand(string(msg.Payload()))
+}
 
+func rainCommand(value string) {
 	state.RainInput.UpdateState(&value)
 	rainInputStateChanged(state.RainInput, &value)
 }
 
 func makeAvailable() {
-	c := *state.Mqtt
+	c := state.Mqtt
 	token := c.Publish(domain.GetAvailabilityTopic(state.Configuration), 0, true, "online")
 	token.Wait()
 	common.LogDebug("Now available")
 }
 
 func makeUnAvailable() {
-	c := *state.Mqtt
+	c := state.Mqtt
 	token := c.Publish(domain.GetAvailabilityTopic(state.Configuration), 0, true, "offline")
 	token.Wait()
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/domain"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestState is like newTestState, but subscribes all entities and runs the window event loops.
+func startTestState(t *testing.T, windows ...domain.CtrlConfigWindow) *domain.MemoryClient {
+	client := newTestState()
+	state.Configuration.Windows = windows
+	state.Windows = nil
+	initEntities()
+	waitIdle(client)
+	t.Cleanup(func() {
+		for _, w := range state.Windows {
+			w.Stop()
+		}
+	})
+	return client
+}
+
+// waitIdle waits until all messages are delivered and all window event loops are idle.
+func waitIdle(client *domain.MemoryClient) {
+	for {
+		published := len(client.Published())
+		client.Flush()
+		for _, w := range state.Windows {
+			w.Sync(func() {})
+		}
+		client.Flush()
+		if len(client.Published()) == published {
+			return
+		}
+	}
+}
+
+func TestConcurrentSensorBursts(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"), testWindowConfig("w02"), testWindowConfig("w03"))
+
+	var wg sync.WaitGroup
+	for _, w := range state.Windows {
+		window := w
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(i%2 == 0))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(i%3 == 0))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				client.Inject(*window.ScheduledInputCover.CommandTopic, strconv.Itoa(i*2))
+				client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(i))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rain := []string{domain.RainNone, domain.RainDrizzle, domain.RainStorm}
+		for i := 0; i < 50; i++ {
+			client.Inject(*state.RainInput.CommandTopic, rain[i%3])
+		}
+	}()
+	wg.Wait()
+	waitIdle(client)
+
+	for _, w := range state.Windows {
+		window := w
+		window.Sync(func() {
+			if len(window.Decisions.Entries()) == 0 {
+				t.Errorf("window %s did not recalculate", window.Id)
+			}
+		})
+	}
+}
+
+func TestManualCoverCommand(t *testing.T) {
+	tests := []struct {
+		payload    string
+		wantManual string
+	}{
+		{"OPEN", "100"},
+		{"CLOSE", "0"},
+		{"STOP", "-2"},
+		{"42", "42"},
+		{`{"position": 17}`, "17"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			client := startTestState(t, testWindowConfig("w01"))
+			window := state.Windows[0]
+
+			client.Inject(*window.ManualInputCover.CommandTopic, tt.payload)
+			waitIdle(client)
+
+			window.Sync(func() {
+				if *window.ManualValue.State != tt.wantManual {
+					t.Errorf("manual value = %q, want %q", *window.ManualValue.State, tt.wantManual)
+				}
+			})
+		})
+	}
+}
+
+func TestDiscoveryPublished(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+
+	for _, topic := range []string{
+		"homeassistant/select/test/test_rain_input/config",
+		"homeassistant/cover/test/test_w_01_manual_cover/config",
+		"homeassistant/switch/test/test_w_01_window_automation/config",
+		"homeassistant/sensor/test/test_w_01_automation_output/config",
+	} {
+		if _, ok := client.Retained(topic); !ok {
+			t.Errorf("no retained discovery config on %s", topic)
+		}
+	}
+	if n := len(client.PublishedTo(fmt.Sprintf("%s/set", testCoverTopic+"_w01"))); n != 0 {
+		t.Errorf("output cover received %d commands on startup, want 0", n)
+	}
+}
+
+func TestDiscoveryMetadata(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Area = "Living room"
+	client := startTestState(t, config)
+
+	discovery := func(topic string) map[string]interface{} {
+		t.Helper()
+		payload, ok := client.Retained(topic)
+		if !ok {
+			t.Fatalf("no retained discovery config on %s", topic)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	controller := discovery("homeassistant/select/test/test_rain_input/config")["device"].(map[string]interface{})
+	if controller["sw_version"] != domain.SoftwareVersion || controller["sw_version"] == "" {
+		t.Errorf("controller sw_version = %v", controller["sw_version"])
+	}
+
+	output := discovery("homeassistant/sensor/test/test_w_01_automation_output/config")
+	device := output["device"].(map[string]interface{})
+	if device["suggested_area"] != "Living room" || device["via_device"] != "test" || device["sw_version"] == nil {
+		t.Errorf("window device = %v", device)
+	}
+	if output["entity_category"] != nil || output["unit_of_measurement"] != "%" {
+		t.Errorf("automation output = %v", output)
+	}
+
+	for _, name := range []string{"calibrating", "window_open_state", "rain_value", "scheduled_value", "manual_value"} {
+		sensor := discovery("homeassistant/sensor/test/test_w_01_" + name + "/config")
+		if sensor["entity_category"] != "diagnostic" {
+			t.Errorf("%s entity_category = %v, want diagnostic", name, sensor["entity_category"])
+		}
+	}
+	// Layers without a value are unknown to Homeassistant rather than non-numeric
+	for _, name := range []string{"automation_output", "rain_value", "scheduled_value", "manual_value", "window_open_value"} {
+		sensor := discovery("homeassistant/sensor/test/test_w_01_" + name + "/config")
+		if sensor["value_template"] != domain.ValueTemplatePosition {
+			t.Errorf("%s value_template = %v, want %s", name, sensor["value_template"], domain.ValueTemplatePosition)
+		}
+	}
+	if options := discovery("homeassistant/sensor/test/test_w_01_window_open_state/config")["options"]; fmt.Sprint(options) != "[0 1 2]" {
+		t.Errorf("window open state options = %v", options)
+	}
+}
+
+func TestThresholdNumber(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	client.Inject(*state.RainInput.CommandTopic, domain.RainDrizzle)
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 50}`)
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":15}` {
+		t.Fatalf("command = %q with the configured threshold, want position 15", command)
+	}
+
+	client.Inject(*window.OpenAndDrizzle.CommandTopic, "30")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":30}` {
+		t.Errorf("command = %q after changing the threshold, want position 30", command)
+	}
+	if val, _ := state.GetState("test_w_01_open_drizzle"); val != "30" {
+		t.Errorf("persisted threshold = %q, want 30", val)
+	}
+
+	client.Inject(*window.OpenAndDrizzle.CommandTopic, "150")
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OpenAndDrizzle.State != "30" {
+			t.Errorf("threshold = %q after an invalid value, want 30", *window.OpenAndDrizzle.State)
+		}
+	})
+
+	// The persisted threshold takes precedence over the configuration
+	restored := newStateWindow(window.Config)
+	if v := getNumberValue(restored.OpenAndDrizzle); v != 30 {
+		t.Errorf("restored threshold = %d, want 30", v)
+	}
+	if v := getNumberValue(restored.OpenAndStorm); v != window.Config.OpenAndStorm {
+		t.Errorf("default threshold = %d, want %d", v, window.Config.OpenAndStorm)
+	}
+}
+
+func TestButtons(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 50}`)
+	client.Inject(*window.ManualInputCover.CommandTopic, "30")
+	waitIdle(client)
+	client.ClearPublished()
+
+	press := func(button *domain.Button) {
+		client.Inject(*button.CommandTopic, "PRESS")
+		waitIdle(client)
+	}
+
+	press(window.ResetManualButton)
+	window.Sync(func() {
+		if *window.ManualValue.State != "" {
+			t.Errorf("manual value = %q after reset, want empty", *window.ManualValue.State)
+		}
+	})
+	if command := lastCommand(client, window); command != `{"position":50}` {
+		t.Errorf("command = %q after reset, want scheduled position 50", command)
+	}
+
+	press(window.StopButton)
+	if command := lastCommand(client, window); command != `{"state":"STOP"}` {
+		t.Errorf("command = %q after stop", command)
+	}
+
+	press(window.ResyncButton)
+	if get := client.PublishedTo(window.Config.OutputCoverStateTopic + "/get"); len(get) != 1 {
+		t.Errorf("resync requested %v", get)
+	}
+
+	press(window.CalibrateButton)
+	if command := lastCommand(client, window); command != `{"state":"OPEN"}` {
+		t.Errorf("command = %q after calibrate", command)
+	}
+
+	// Other payloads than the press payload are ignored
+	client.ClearPublished()
+	client.Inject(*window.StopButton.CommandTopic, "ON")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != "" {
+		t.Errorf("command = %q for an invalid payload", command)
+	}
+
+	decisions := len(window.Decisions.Entries())
+	press(state.Recalculate)
+	if n := len(window.Decisions.Entries()); n != decisions+1 {
+		t.Errorf("recalculate all recorded %d decisions, want 1", n-decisions)
+	}
+}
+
+func TestContactDebounce(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.WindowSensorDebounceMs = 30
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(0))
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+	openState := func() string {
+		var s string
+		window.Sync(func() {
+			s = *window.WindowOpenState.State
+		})
+		return s
+	}
+
+	// Opening is applied right away
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+	if s := openState(); s != "2" {
+		t.Errorf("window open state = %q right after opening, want 2", s)
+	}
+
+	// Closing is held back, flapping keeps the window open
+	for i := 0; i < 6; i++ {
+		client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(i%2 == 0))
+	}
+	waitIdle(client)
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+	if s := openState(); s != "2" {
+		t.Errorf("window open state = %q after flapping, want 2", s)
+	}
+
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	waitIdle(client)
+	if s := openState(); s != "2" {
+		t.Errorf("window open state = %q within the debounce time, want 2", s)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+	if s := openState(); s != "0" {
+		t.Errorf("window open state = %q after the debounce time, want 0", s)
+	}
+}
+
+// TestContactMaxDebounce applies the state of a sensor reporting more often than its debounce time at the latest
+// after the maximum deferral.
+func TestContactMaxDebounce(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.WindowSensorDebounceMs = 30
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+
+	deadline := time.Now().Add(time.Second)
+	for battery := 100; time.Now().Before(deadline); battery-- {
+		client.Inject(window.Config.WindowSensorStateTopic, fmt.Sprintf(`{"contact":true,"battery":%d}`, battery))
+		time.Sleep(10 * time.Millisecond)
+		var closed bool
+		window.Sync(func() {
+			closed = *window.WindowOpenState.State == "0"
+		})
+		if closed {
+			return
+		}
+	}
+	t.Errorf("closing of a sensor reporting every 10ms was deferred for more than a second")
+}
@@ -1,8 +1,18 @@
 module shutter_control
 
-go 1.10
+go 1.21
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/iancoleman/strcase v0.2.0
+	github.com/mochi-mqtt/server/v2 v2.7.9
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// applyGroupThresholds replaces the rain thresholds of the windows of a group with the thresholds set for the group.
+func applyGroupThresholds() {
+	for _, g := range state.Configuration.Groups {
+		for _, id := range g.Windows {
+			for i := range state.Configuration.Windows {
+				w := &state.Configuration.Windows[i]
+				if w.Id != id {
+					continue
+				}
+				if g.OpenAndDrizzle != nil {
+					w.OpenAndDrizzle = *g.OpenAndDrizzle
+				}
+				if g.OpenAndStorm != nil {
+					w.OpenAndStorm = *g.OpenAndStorm
+				}
+				if g.TiltedAndDrizzle != nil {
+					w.TiltedAndDrizzle = *g.TiltedAndDrizzle
+				}
+				if g.TiltedAndStorm != nil {
+					w.TiltedAndStorm = *g.TiltedAndStorm
+				}
+			}
+		}
+	}
+}
+
+func initGroups() {
+	state.Groups = make([]*domain.StateGroup, 0)
+	for i := range state.Configuration.Groups {
+		g := newStateGroup(&state.Configuration.Groups[i])
+		if g == nil {
+			continue
+		}
+		subscribeGroup(g)
+		state.Groups = append(state.Groups, g)
+	}
+}
+
+// newStateGroup creates and initializes the entities of a group and attaches it to its windows, the windows must be
+// running already.
+func newStateGroup(g *domain.CtrlConfigGroup) *domain.StateGroup {
+	sg := &domain.StateGroup{
+		Id:     g.Id,
+		Config: g,
+	}
+	for _, id := range g.Windows {
+		window := windowById(id)
+		if window == nil {
+			common.LogWarning(fmt.Sprintf("Ignoring unknown window %s of group %s", id, g.Id))
+			continue
+		}
+		sg.Windows = append(sg.Windows, window)
+	}
+	if len(sg.Windows) == 0 {
+		common.LogWarning(fmt.Sprintf("Ignoring group %s without windows", g.Id))
+		return nil
+	}
+
+	device := domain.Device{
+		Identifiers:   state.Configuration.NodeId + "_" + g.Id,
+		Manufacturer:  domain.Manufacturer,
+		Model:         domain.GroupName,
+		Name:          "group_" + g.Id,
+		SuggestedArea: g.Area,
+		SwVersion:     domain.SoftwareVersion,
+		ViaDevice:     state.Configuration.NodeId,
+	}
+
+	sg.Cover = &domain.Cover{
+		Device:   &device,
+		Name:     String(g.Id + "_group_cover"),
+		AppState: &state,
+		CommandFunc: func(client mqtt.Client, msg mqtt.Message) {
+			groupCoverCommand(sg, string(msg.Payload()))
+		},
+	}
+	sg.Automation = &domain.Switch{
+		Device:   &device,
+		Name:     String(g.Id + "_group_automation"),
+		AppState: &state,
+		CommandFunc: func(client mqtt.Client, msg mqtt.Message) {
+			groupAutomationCommand(sg, string(msg.Payload()))
+		},
+	}
+
+	first := sg.Windows[0]
+	sg.OpenAndDrizzle = newGroupThresholdNumber(sg, &device, g.Id+"_open_drizzle", groupThresholdDefault(g.OpenAndDrizzle, first, 0), 0)
+	sg.OpenAndStorm = newGroupThresholdNumber(sg, &device, g.Id+"_open_storm", groupThresholdDefault(g.OpenAndStorm, first, 1), 1)
+	sg.TiltedAndDrizzle = newGroupThresholdNumber(sg, &device, g.Id+"_tilted_drizzle", groupThresholdDefault(g.TiltedAndDrizzle, first, 2), 2)
+	sg.TiltedAndStorm = newGroupThresholdNumber(sg, &device, g.Id+"_tilted_storm", groupThresholdDefault(g.TiltedAndStorm, first, 3), 3)
+
+	sg.Cover.Initialize(true)
+	sg.Automation.Initialize()
+	configured := []*int{g.OpenAndDrizzle, g.OpenAndStorm, g.TiltedAndDrizzle, g.TiltedAndStorm}
+	for i, n := range groupThresholds(sg) {
+		n.Initialize()
+		// A threshold of the group, configured or set in Homeassistant, replaces the thresholds persisted for its windows
+		if _, persisted := state.GetState(*n.UniqueId); configured[i] != nil || persisted {
+			applyGroupThreshold(sg, i, *n.State)
+		}
+	}
+
+	// Seed the aggregated state with the current state of the windows, later changes are pushed by the windows
+	for _, w := range sg.Windows {
+		window := w
+		window.Sync(func() {
+			window.Groups = append(window.Groups, sg)
+			updateGroup(sg, window)
+		})
+	}
+
+	return sg
+}
+
+// newGroupThresholdNumber creates a number entity for a rain threshold of a group, setting it sets the threshold with
+// the given index of all windows of the group.
+func newGroupThresholdNumber(sg *domain.StateGroup, device *domain.Device, name string, value int, index int) *domain.Number {
+	number := newThresholdNumber(device, name, value)
+	number.StateUpdatedFunc = nil
+	number.CommandFunc = func(client mqtt.Client, msg mqtt.Message) {
+		if !thresholdCommand(number, string(msg.Payload())) {
+			return
+		}
+		value := *number.State
+		for _, w := range sg.Windows {
+			window := w
+			window.Dispatch(func() {
+				thresholdCommand(windowThresholds(window)[index], value)
+			})
+		}
+	}
+	return number
+}
+
+// groupThresholdDefault returns the threshold configured for the group, without one the current threshold of its
+// first window.
+func groupThresholdDefault(value *int, first *domain.StateWindow, index int) int {
+	if value != nil {
+		return *value
+	}
+	var v int
+	first.Sync(func() {
+		v = getNumberValue(windowThresholds(first)[index])
+	})
+	return v
+}
+
+// applyGroupThreshold sets the threshold with the given index of all windows of the group.
+func applyGroupThreshold(sg *domain.StateGroup, index int, value string) {
+	for _, w := range sg.Windows {
+		window := w
+		window.Sync(func() {
+			if *windowThresholds(window)[index].State != value {
+				thresholdCommand(windowThresholds(window)[index], value)
+			}
+		})
+	}
+}
+
+func groupThresholds(sg *domain.StateGroup) []*domain.Number {
+	return []*domain.Number{sg.OpenAndDrizzle, sg.OpenAndStorm, sg.TiltedAndDrizzle, sg.TiltedAndStorm}
+}
+
+func subscribeGroup(sg *domain.StateGroup) {
+	sg.Cover.Subscribe()
+	sg.Automation.Subscribe()
+	for _, n := range groupThresholds(sg) {
+		n.Subscribe()
+	}
+}
+
+func windowById(id string) *domain.StateWindow {
+	for _, w := range state.Windows {
+		if w.Id == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// groupCoverCommand sends a command of the group cover as manual command to all windows of the group.
+func groupCoverCommand(sg *domain.StateGroup, value string) {
+	common.LogDebug(fmt.Sprintf("Group %s cover command %s", sg.Id, value))
+	for _, w := range sg.Windows {
+		window := w
+		window.Dispatch(func() {
+			manualCoverCommand(window, value)
+		})
+	}
+}
+
+// groupAutomationCommand switches the automation of all windows of the group.
+func groupAutomationCommand(sg *domain.StateGroup, value string) {
+	common.LogDebug(fmt.Sprintf("Group %s automation %s", sg.Id, value))
+	for _, w := range sg.Windows {
+		window := w
+		window.Dispatch(func() {
+			window.Automation.UpdateState(&value)
+		})
+	}
+}
+
+// updateGroups publishes the aggregated state of the groups of the window, must be called on its event loop.
+func updateGroups(window *domain.StateWindow) {
+	for _, g := range window.Groups {
+		updateGroup(g, window)
+	}
+}
+
+func updateGroup(sg *domain.StateGroup, window *domain.StateWindow) {
+	sg.Update(window.Id, getWindowPosition(window), automationEnabled(window), func(position int, automation bool) {
+		coverState := "OPEN"
+		if position == 0 {
+			coverState = "CLOSE"
+		}
+		var current domain.CoverState
+		json.Unmarshal([]byte(sg.Cover.GetState()), &current)
+		if current.Position == nil || *current.Position != position || current.State == nil || *current.State != coverState {
+			j, _ := json.Marshal(CoverStateAndPosition{State: String(coverState), Position: Int(position)})
+			sg.Cover.UpdateState(String(string(j)))
+		}
+
+		automationState := "OFF"
+		if automation {
+			automationState = "ON"
+		}
+		if automationState != sg.Automation.GetState() {
+			sg.Automation.UpdateState(&automationState)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"shutter_control/domain"
+	"testing"
+)
+
+func startGroupTestState(t *testing.T, groups ...domain.CtrlConfigGroup) *domain.MemoryClient {
+	client := newTestState()
+	state.Configuration.Windows = []domain.CtrlConfigWindow{testWindowConfig("w01"), testWindowConfig("w02"), testWindowConfig("w03")}
+	state.Configuration.Groups = groups
+	state.Windows = nil
+	initEntities()
+	waitIdle(client)
+	t.Cleanup(func() {
+		for _, w := range state.Windows {
+			w.Stop()
+		}
+	})
+	return client
+}
+
+func groupCoverPosition(t *testing.T, client *domain.MemoryClient, g *domain.StateGroup) int {
+	t.Helper()
+	published := client.PublishedTo(*g.Cover.StateTopic)
+	if len(published) == 0 {
+		t.Fatalf("no state of group cover %s", g.Id)
+	}
+	var s domain.CoverState
+	json.Unmarshal([]byte(published[len(published)-1]), &s)
+	return *s.Position
+}
+
+func TestGroupCover(t *testing.T) {
+	client := startGroupTestState(t, domain.CtrlConfigGroup{Id: "south", Windows: []string{"w01", "w02", "unknown"}})
+	if len(state.Groups) != 1 || len(state.Groups[0].Windows) != 2 {
+		t.Fatalf("groups = %v", state.Groups)
+	}
+	group := state.Groups[0]
+	if _, ok := client.Retained("homeassistant/cover/test/test_south_group_cover/config"); !ok {
+		t.Errorf("no discovery config of the group cover")
+	}
+
+	client.Inject(state.Windows[0].Config.OutputCoverStateTopic, *coverPayload(20))
+	client.Inject(state.Windows[1].Config.OutputCoverStateTopic, *coverPayload(61))
+	client.Inject(state.Windows[2].Config.OutputCoverStateTopic, *coverPayload(100))
+	waitIdle(client)
+	if p := groupCoverPosition(t, client, group); p != 41 {
+		t.Errorf("group position = %d, want 41", p)
+	}
+
+	client.Inject(*group.Cover.CommandTopic, `{ "position": 30 }`)
+	waitIdle(client)
+	for _, w := range state.Windows {
+		window := w
+		want := "30"
+		if window.Id == "w03" {
+			want = ""
+		}
+		window.Sync(func() {
+			if *window.ManualValue.State != want {
+				t.Errorf("window %s manual value = %q, want %q", window.Id, *window.ManualValue.State, want)
+			}
+		})
+	}
+}
+
+func TestGroupAutomation(t *testing.T) {
+	client := startGroupTestState(t, domain.CtrlConfigGroup{Id: "south", Windows: []string{"w01", "w02"}})
+	group := state.Groups[0]
+	if s := group.Automation.GetState(); s != "ON" {
+		t.Fatalf("group automation = %q, want ON", s)
+	}
+
+	client.Inject(*group.Automation.CommandTopic, "OFF")
+	waitIdle(client)
+	for _, w := range group.Windows {
+		window := w
+		window.Sync(func() {
+			if *window.Automation.State != "OFF" {
+				t.Errorf("window %s automation = %q, want OFF", window.Id, *window.Automation.State)
+			}
+		})
+	}
+	if s := client.PublishedTo(*group.Automation.StateTopic); len(s) == 0 || s[len(s)-1] != "OFF" {
+		t.Errorf("group automation = %q, want OFF", s)
+	}
+
+	client.Inject(*group.Windows[0].Automation.CommandTopic, "ON")
+	waitIdle(client)
+	if s := group.Automation.GetState(); s != "OFF" {
+		t.Errorf("group automation = %q with one window off, want OFF", s)
+	}
+	client.Inject(*group.Windows[1].Automation.CommandTopic, "ON")
+	waitIdle(client)
+	if s := group.Automation.GetState(); s != "ON" {
+		t.Errorf("group automation = %q with all windows on, want ON", s)
+	}
+}
+
+func TestGroupThresholds(t *testing.T) {
+	client := startGroupTestState(t, domain.CtrlConfigGroup{Id: "south", Windows: []string{"w01", "w02"}, OpenAndDrizzle: Int(40)})
+	group := state.Groups[0]
+	w03 := state.Windows[2]
+
+	for _, w := range group.Windows {
+		if v := getNumberValue(w.OpenAndDrizzle); v != 40 {
+			t.Errorf("window %s threshold = %d, want 40 of the group", w.Id, v)
+		}
+	}
+	if v := getNumberValue(group.OpenAndDrizzle); v != 40 {
+		t.Errorf("group threshold = %d, want 40", v)
+	}
+
+	client.Inject(*group.OpenAndStorm.CommandTopic, "25")
+	client.Inject(*group.OpenAndDrizzle.CommandTopic, "101")
+	waitIdle(client)
+	for _, w := range group.Windows {
+		window := w
+		window.Sync(func() {
+			if v := getNumberValue(window.OpenAndStorm); v != 25 {
+				t.Errorf("window %s open storm = %d, want 25", window.Id, v)
+			}
+			if v := getNumberValue(window.OpenAndDrizzle); v != 40 {
+				t.Errorf("window %s open drizzle = %d after an invalid value, want 40", window.Id, v)
+			}
+		})
+	}
+	w03.Sync(func() {
+		if v := getNumberValue(w03.OpenAndStorm); v != w03.Config.OpenAndStorm {
+			t.Errorf("window outside the group changed to %d", v)
+		}
+	})
+}
+
+func TestGroupThresholdsReplacePersisted(t *testing.T) {
+	client := newTestState()
+	state.Configuration.Windows = []domain.CtrlConfigWindow{testWindowConfig("w01"), testWindowConfig("w02")}
+	state.Configuration.Groups = []domain.CtrlConfigGroup{{Id: "south", Windows: []string{"w01", "w02"}, OpenAndDrizzle: Int(40)}}
+	// Set in Homeassistant before the group existed, and for the group itself
+	state.States["test_w_01_open_drizzle"] = "70"
+	state.States["test_w_02_tilted_storm"] = "5"
+	state.States["test_south_tilted_storm"] = "30"
+	state.Windows = nil
+	initEntities()
+	waitIdle(client)
+	t.Cleanup(func() {
+		for _, w := range state.Windows {
+			w.Stop()
+		}
+	})
+
+	group := state.Groups[0]
+	for _, w := range group.Windows {
+		window := w
+		window.Sync(func() {
+			if v := getNumberValue(window.OpenAndDrizzle); v != 40 {
+				t.Errorf("window %s open drizzle = %d, want 40 of the group", window.Id, v)
+			}
+			if v := getNumberValue(window.TiltedAndStorm); v != 30 {
+				t.Errorf("window %s tilted storm = %d, want 30 persisted for the group", window.Id, v)
+			}
+		})
+	}
+}
+
+func TestGroupThresholdsSeededFromGroup(t *testing.T) {
+	startGroupTestState(t, domain.CtrlConfigGroup{Id: "south", Windows: []string{"w01", "w02"}, TiltedAndDrizzle: Int(33)})
+	group := state.Groups[0]
+	if v := getNumberValue(group.TiltedAndDrizzle); v != 33 {
+		t.Errorf("group tilted drizzle = %d, want 33 of the group", v)
+	}
+	if v := getNumberValue(group.OpenAndStorm); v != testWindowConfig("w01").OpenAndStorm {
+		t.Errorf("group open storm = %d, want the threshold of its first window", v)
+	}
+}
+
+func TestGroupAutomationMasterSwitch(t *testing.T) {
+	client := startGroupTestState(t, domain.CtrlConfigGroup{Id: "south", Windows: []string{"w01", "w02"}})
+	group := state.Groups[0]
+
+	client.Inject(*state.Automation.CommandTopic, "OFF")
+	waitIdle(client)
+	if s := group.Automation.GetState(); s != "OFF" {
+		t.Errorf("group automation = %q with the master switch off, want OFF", s)
+	}
+	client.Inject(*state.Automation.CommandTopic, "ON")
+	waitIdle(client)
+	if s := group.Automation.GetState(); s != "ON" {
+		t.Errorf("group automation = %q with the master switch on, want ON", s)
+	}
+}
@@ -10,26 +10,80 @@ import (
 	"time"
 )
 
+// calibrationDelay is the time granted to the output cover to apply the calibration time before it is opened.
+var calibrationDelay = 1 * time.Second
+
 func getContactSensorValue(sensor *domain.BinarySensor) bool {
-	if sensor == nil {
-		return true
+	closed, _ := getContactState(sensor)
+	return closed
+}
+
+// getContactState returns whether the contact of the sensor is closed and whether the sensor reported it. Payloads
+// without contact are treated as closed, like a sensor which did not report yet.
+func getContactState(sensor *domain.BinarySensor) (closed bool, known bool) {
+	if sensor == nil || sensor.State == nil {
+		return true, false
 	}
-	s := sensor.State
-	if s != nil {
-		var os domain.AqaraDoorSensorState
-		json.Unmarshal([]byte(*s), &os)
-		return *(&os.Contact)
+	var os struct {
+		Contact *bool `json:"contact"`
 	}
-	return true
+	if err := json.Unmarshal([]byte(*sensor.State), &os); err != nil || os.Contact == nil {
+		return true, false
+	}
+	return *os.Contact, true
+}
+
+// contactMaxDebounce limits how long a flapping contact sensor defers its state, in multiples of its debounce time.
+const contactMaxDebounce = 5
+
+// contactOpening reports whether a contact sensor payload reports the contact open. Opening is applied without
+// debounce, a window or door must never be treated as closed longer than it is.
+func contactOpening(payload string) bool {
+	var os struct {
+		Contact *bool `json:"contact"`
+	}
+	return json.Unmarshal([]byte(payload), &os) == nil && os.Contact != nil && !*os.Contact
 }
+
+// contactInconsistency returns why the contact sensors of the window are not plausible, or "" if they are. A window
+// can not be open without being tilted as well, the open sensor takes precedence then.
+func contactInconsistency(window *domain.StateWindow) string {
+	for _, sensor := range []*domain.BinarySensor{window.WindowOpenInputSensor, window.WindowTiltedInputSensor} {
+		if _, known := getContactState(sensor); sensor != nil && sensor.State != nil && !known {
+			return fmt.Sprintf("%s reported no contact: %s", *sensor.UniqueId, *sensor.State)
+		}
+	}
+	openClosed, openKnown := getContactState(window.WindowOpenInputSensor)
+	tiltedClosed, tiltedKnown := getContactState(window.WindowTiltedInputSensor)
+	if openKnown && tiltedKnown && !openClosed && tiltedClosed {
+		return "open without tilted"
+	}
+	return ""
+}
+
+func checkContactConsistency(window *domain.StateWindow) {
+	inconsistent := "OFF"
+	if reason := contactInconsistency(window); reason != "" {
+		inconsistent = "ON"
+		if *window.ContactInconsistent.State != inconsistent {
+			common.LogWarning(fmt.Sprintf("Contact sensors of window %s are inconsistent, %s", window.Id, reason))
+		}
+	}
+	if *window.ContactInconsistent.State != inconsistent {
+		window.ContactInconsistent.UpdateState(&inconsistent)
+	}
+}
+
 func calculateWindowValue(window *domain.StateWindow) {
-	windowOpen := !getContactSensorValue(window.WindowOpenInputSensor)
-	windowTilted := !getContactSensorValue(window.WindowTiltedInputSensor)
-	scheduledPosition, _ := strconv.Atoi(*window.ScheduledValue.State)
-	rainValue := state.RainInput.State
+	windowOpen := !contactClosed(window.WindowOpenInputSensor, window.OpenSensorOffline)
+	windowTilted := !contactClosed(window.WindowTiltedInputSensor, window.TiltedSensorOffline)
+	checkContactConsistency(window)
+	calculateClimateValue(window, time.Now())
+	scheduledPosition := basePosition(window)
+	rainValue := state.RainInput.GetState()
 
 	openAndClosed := 100
-	tiltedAndClosed := window.Config.TiltedAndClosed
+	tiltedAndClosed := getNumberValue(window.TiltedAndClosed)
 	if windowOpen && scheduledPosition < openAndClosed {
 		window.WindowOpenValue.UpdateState(String(strconv.Itoa(openAndClosed)))
 	} else if !windowOpen && windowTilted && scheduledPosition < tiltedAndClosed {
@@ -46,31 +100,34 @@ func calculateWindowValue(window *domain.StateWindow) {
 		window.WindowOpenState.UpdateState(String("0"))
 	}
 
-	openAndDrizzle := window.Config.OpenAndDrizzle
-	openAndStorm := window.Config.OpenAndStorm
-	tiltedAndDrizzle := window.Config.TiltedAndDrizzle
-	tiltedAndStorm := window.Config.TiltedAndStorm
+	openAndDrizzle := getNumberValue(window.OpenAndDrizzle)
+	openAndStorm := getNumberValue(window.OpenAndStorm)
+	tiltedAndDrizzle := getNumberValue(window.TiltedAndDrizzle)
+	tiltedAndStorm := getNumberValue(window.TiltedAndStorm)
 
-	if windowOpen && *rainValue == domain.RainDrizzle && scheduledPosition > openAndDrizzle {
+	if windowOpen && rainValue == domain.RainDrizzle && scheduledPosition > openAndDrizzle {
 		window.RainValue.UpdateState(String(strconv.Itoa(openAndDrizzle)))
-	} else if windowOpen && *rainValue == domain.RainStorm && scheduledPosition > openAndStorm {
+	} else if windowOpen && rainValue == domain.RainStorm && scheduledPosition > openAndStorm {
 		window.RainValue.UpdateState(String(strconv.Itoa(openAndStorm)))
-	} else if !windowOpen && windowTilted && *rainValue == domain.RainDrizzle && scheduledPosition > tiltedAndDrizzle {
+	} else if !windowOpen && windowTilted && rainValue == domain.RainDrizzle && scheduledPosition > tiltedAndDrizzle {
 		window.RainValue.UpdateState(String(strconv.Itoa(tiltedAndDrizzle)))
-	} else if !windowOpen && windowTilted && *rainValue == domain.RainStorm && scheduledPosition > tiltedAndStorm {
+	} else if !windowOpen && windowTilted && rainValue == domain.RainStorm && scheduledPosition > tiltedAndStorm {
 		window.RainValue.UpdateState(String(strconv.Itoa(tiltedAndStorm)))
 	} else {
 		window.RainValue.UpdateState(String(""))
 	}
+	calculateRainTilt(window)
 }
 func windowOpenStateChanged(sensor *domain.BinarySensor, newState *bool, oldState *bool) {
 	window := sensor.Window
+	checkContactHealth(sensor, window.OpenSensorOffline, window.OpenSensorLowBattery, time.Now())
 	calculateWindowValue(window)
 	recalculateWindow(sensor.Window)
 }
 
 func windowTiltedStateChanged(sensor *domain.BinarySensor, newState *bool, oldState *bool) {
 	window := sensor.Window
+	checkContactHealth(sensor, window.TiltedSensorOffline, window.TiltedSensorLowBattery, time.Now())
 	calculateWindowValue(window)
 	recalculateWindow(sensor.Window)
 }
@@ -85,18 +142,29 @@ func manualCoverStateChanged(cover *domain.Cover, newPosition int) {
 
 func scheduledCoverStateChanged(cover *domain.Cover, newState *domain.CoverState, oldState *domain.CoverState) {
 	window := cover.Window
+	if newState.Position == nil {
+		common.LogWarning(fmt.Sprintf("Ignoring scheduled input %s without position", *cover.UniqueId))
+		return
+	}
 	position := strconv.Itoa(*newState.Position)
-	if *window.Automation.State == "ON" {
+	if automationEnabled(window) {
 		common.LogDebug(fmt.Sprintf("Scheduled input %s changed, resetting manual value", *cover.UniqueId))
 		window.ManualValue.UpdateState(String(""))
+		clearManualTilt(window)
 	}
 	window.ScheduledValue.UpdateState(&position)
+	if window.ScheduledTiltValue != nil && newState.Tilt != nil {
+		window.ScheduledTiltValue.UpdateState(String(strconv.Itoa(*newState.Tilt)))
+	}
 	calculateWindowValue(window)
 	recalculateWindow(window)
 }
 func outputCoverStateChanged(cover *domain.Cover, newState *domain.CoverState, oldState *domain.CoverState) {
 	window := cover.Window
 
+	if newState.Moving != nil && *newState.Moving == "STOP" {
+		state.Commands.Stopped(cover)
+	}
 	if newState.Moving == nil || oldState.Moving == nil || newState.Position == nil {
 		return
 	}
@@ -104,7 +172,7 @@ func outputCoverStateChanged(cover *domain.Cover, newState *domain.CoverState, o
 	if *newState.Moving == "STOP" && *oldState.Moving == "UP" && *newState.Position == 99 {
 		common.LogDebug(fmt.Sprintf("Recalculating window value for %s as it was moving UP and now stopped at 99, new state is STOP", window.Id))
 		recalculateWindow(window)
-	} else if *newState.Moving == "STOP" && *newState.Position == 100 {
+	} else if *newState.Moving == "STOP" && *newState.Position == 100 && outputsReached(window, 100) {
 		common.LogDebug(fmt.Sprintf("Window value for %s as it was moving UP and now stopped at 100, new state is STOP: calibrating done", window.Id))
 		calibratingValueS := strconv.Itoa(0)
 		window.Calibrating.UpdateState(&calibratingValueS)
@@ -119,25 +187,26 @@ func automationSwitchStateChanged(switchObj *domain.Switch, newState *string) {
 	if *newState == "ON" {
 		common.LogDebug(fmt.Sprintf("Automation for window %s enabled, resetting manual value and recalculating window", window.Id))
 		window.ManualValue.UpdateState(String(""))
+		clearManualTilt(window)
 		recalculateWindow(window)
 	}
 }
 
-func rainInputStateChanged(rainValue *domain.Select, newState *string) {
+func thresholdChanged(number *domain.Number, newState *string) {
+	window := number.Window
+	common.LogDebug(fmt.Sprintf("Threshold %s changed to %s, recalculating window %s", *number.UniqueId, *newState, window.Id))
+	calculateWindowValue(window)
+	recalculateWindow(window)
+}
 
-	for _, w := range rainValue.AppState.Windows {
-		calculateWindowValue(&w)
-		recalculateWindow(&w)
-	}
+func rainInputStateChanged(rainValue *domain.Select, newState *string) {
+	recalculateAll()
 }
 
 func recalculateWindow(window *domain.StateWindow) {
-	currentPosition := getCoverPosition(window.OutputCover)
+	currentPosition := getWindowPosition(window)
 	var automationValue int
-	scheduledPosition, e := strconv.Atoi(*window.ScheduledValue.State)
-	if e != nil {
-		scheduledPosition = 0
-	}
+	scheduledPosition := basePosition(window)
 	windowOpenPosition, e := strconv.Atoi(*window.WindowOpenValue.State)
 	if e != nil {
 		windowOpenPosition = -1
@@ -163,10 +232,10 @@ func recalculateWindow(window *domain.StateWindow) {
 		automationValue = manualPosition
 	}
 	if windowOpenPosition >= 0 || rainPosition != -1 || manualPosition != -1 {
-		if *window.Automation.State == "ON" && automationValue == 100 && currentPosition < 99 {
+		if automationEnabled(window) && automationValue == 100 && currentPosition < 99 {
 			common.LogDebug(fmt.Sprintf("Fix automation value for %s to 99 instead of 100 (current position is %d)", window.Id, currentPosition))
 			automationValue = 99
-		} else if *window.Automation.State != "ON" && manualPosition == 100 && manualPosition < 99 {
+		} else if !automationEnabled(window) && manualPosition == 100 && manualPosition < 99 {
 			common.LogDebug(fmt.Sprintf("Fix manual value for %s to 99 instead of 100 (current position is %d)", window.Id, currentPosition))
 			manualPosition = 99
 		}
@@ -174,15 +243,73 @@ func recalculateWindow(window *domain.StateWindow) {
 
 	automationValueS := strconv.Itoa(automationValue)
 	window.OutputValue.UpdateState(&automationValueS)
-
-	if *window.Automation.State == "ON" {
+	recalculateTilt(window)
+
+	decision := domain.Decision{
+		Time:       time.Now(),
+		Window:     window.Id,
+		Automation: *window.Automation.State,
+		Suspended:  !masterAutomationEnabled(),
+		Scheduled:  *window.ScheduledValue.State,
+		Vacation:   *window.VacationValue.State,
+		Shading:    *window.ShadingValue.State,
+		Heat:       *window.HeatValue.State,
+		Insulation: *window.InsulationValue.State,
+		WindowOpen: *window.WindowOpenValue.State,
+		Rain:       *window.RainValue.State,
+		Manual:     *window.ManualValue.State,
+		Current:    currentPosition,
+		Positions:  coverPositions(window),
+	}
+	if window.OutputTiltValue != nil {
+		decision.Tilt = *window.OutputTiltValue.State
+	}
+	if automationEnabled(window) {
 		// Tell cover the automationValue
-		updateCover(window, automationValue)
+		decision.Chosen = automationValue
 	} else {
 		// Tell cover the manualPosition
-		updateCover(window, manualPosition)
+		decision.Chosen = manualPosition
 	}
+	decision.Command, decision.Skipped = updateCover(window, decision.Chosen, commandPriority(window, rainPosition, manualPosition))
+	decision.Calibration = decision.Chosen == 100 && currentPosition != 100 && decision.Command != ""
+	recordDecision(window, decision)
+}
+
+// commandPriority lets commands caused by rain jump the queue of the scheduler, followed by manual commands.
+func commandPriority(window *domain.StateWindow, rainPosition int, manualPosition int) int {
+	if !automationEnabled(window) || manualPosition != -1 {
+		return domain.PriorityManual
+	}
+	if rainPosition != -1 {
+		return domain.PriorityRain
+	}
+	return domain.PriorityNormal
+}
 
+// automationEnabled reports whether the automation of the window is on and not suspended by the master switch.
+func automationEnabled(window *domain.StateWindow) bool {
+	return *window.Automation.State == "ON" && masterAutomationEnabled()
+}
+
+func masterAutomationEnabled() bool {
+	return state.Automation == nil || state.Automation.GetState() == "ON"
+}
+
+// scheduledValue returns the scheduled position, replaced by the vacation position while the vacation mode is on.
+func scheduledValue(window *domain.StateWindow) string {
+	if vacationEnabled() && window.VacationValue.State != nil && *window.VacationValue.State != "" {
+		return *window.VacationValue.State
+	}
+	return *window.ScheduledValue.State
+}
+
+func getNumberValue(number *domain.Number) int {
+	if number == nil || number.State == nil {
+		return 0
+	}
+	f, _ := strconv.ParseFloat(*number.State, 64)
+	return int(math.Round(f))
 }
 
 func getCoverPosition(sensor *domain.Cover) int {
@@ -199,81 +326,154 @@ func getCoverPosition(sensor *domain.Cover) int {
 }
 func Int(v int) *int { return &v }
 
+func Float(v float64) *float64 { return &v }
+
 type CoverStatePosition struct {
-	Position *int `json:"position"`
+	Position *int `json:"position,omitempty"`
+	Tilt     *int `json:"tilt,omitempty"`
 }
 
 type CoverStateOnly struct {
 	State *string `json:"state"`
 }
 
-func updateCover(window *domain.StateWindow, value int) {
-	currentPosition := getCoverPosition(window.OutputCover)
-	var newState CoverStatePosition
+// updateCover moves the output covers to the given value and returns the command sent, or the reason why no command
+// was sent.
+func updateCover(window *domain.StateWindow, value int, priority int) (command string, skipped string) {
+	currentPosition := getWindowPosition(window)
 	var newStateString string
 	var valueToGo = value
+	var tilt *int
+	if t := tiltTarget(window); t >= 0 {
+		tilt = Int(t)
+	}
 
 	if value == -2 {
-		s := CoverStateOnly{
-			State: String("STOP"),
-		}
-		j, _ := json.Marshal(s)
-		newStateString = string(j)
+		newStateString = stopCoverCommand
 	} else if value == -1 {
 
-		return
+		return "", "no value"
 	} else if value == 100 && currentPosition != 100 {
-		calibratingValueS := strconv.Itoa(1)
-		window.Calibrating.UpdateState(&calibratingValueS)
-		common.LogDebug(fmt.Sprintf("Fixing calibration time to set value to 100 for window %s/%s (output cover: %s)", window.Id, window.Config.Id, window.Config.OutputCoverStateTopic))
+		newStateString = calibrationCommand()
+	} else {
+		valueToGo = coverTarget(window.Config.CoverOutputs()[0], value, getCoverPosition(window.OutputCover))
+		newStateString = positionCommand(valueToGo, tilt)
+		window.CoverCommands = outputCommands(window, value, tilt)
+	}
+	reached := value >= 0 && outputsReached(window, value)
+
+	if reached && tilt != nil && !outputsTilted(window, *tilt) && *window.Calibrating.State != "1" {
+		// Only the slats need to move
+		j, _ := json.Marshal(CoverStatePosition{Tilt: tilt})
+		common.LogDebug(fmt.Sprintf("Updating tilt of main cover %s=%d", window.OutputCover.GetUniqueId(), *tilt))
+		moveCover(window, string(j), priority)
+		return string(j), ""
+	}
+	if reached {
+		common.LogDebug(fmt.Sprintf("Skipping main cover update %s, new value %d equals current position %d", window.OutputCover.GetUniqueId(), value, currentPosition))
+		state.Commands.Cancel(window.OutputCover)
+		clearAck(window)
+		cancelMove(window)
+		return "", "equal position"
+	}
+	if value >= 0 && valueToGo < currentPosition && lockedOut(window) {
+		common.LogDebug(fmt.Sprintf("Skipping main cover update %s, door of window %s is open", window.OutputCover.GetUniqueId(), window.Id))
+		lockoutCover(window)
+		return "", "door open"
+	}
+	currentCalibrating, e := strconv.Atoi(*window.Calibrating.State)
+	if e != nil || currentCalibrating == 1 && valueToGo != 100 {
+		common.LogDebug(fmt.Sprintf("Skipping main cover update %s, cover currently in calibration", window.OutputCover.GetUniqueId()))
+		return "", "calibration in progress"
+	}
 
-		// Only to reset CalibrationTime and thus setting the position to 0
-		token := (*window.OutputCover.AppState.Mqtt).Publish(window.Config.OutputCoverStateTopic+"/set/calibration_time", 0, false, strconv.Itoa(window.Config.OutputCoverTimeUp+10))
-		token.Wait()
+	common.LogDebug(fmt.Sprintf("Updating main cover %s=%d (%s, current=%d)", window.OutputCover.GetUniqueId(), value, newStateString, currentPosition))
 
-		token = (*window.OutputCover.AppState.Mqtt).Publish(window.Config.OutputCoverStateTopic+"/set/calibration_time", 0, false, strconv.Itoa(window.Config.OutputCoverTimeUp))
-		token.Wait()
-		time.Sleep(1 * time.Second)
+	moveCover(window, newStateString, priority)
+	return newStateString, ""
+}
 
-		s := CoverStateOnly{
-			State: String("OPEN"),
-		}
-		j, _ := json.Marshal(s)
-		newStateString = string(j)
-	} else if value < currentPosition && value != 0 {
-		factor := float64(window.Config.OutputCoverTimeUp) / float64(window.Config.OutputCoverTimeDown)
+// calibrateCommand calibrates the output cover right away, once fully open the window is recalculated.
+func calibrateCommand(window *domain.StateWindow) {
+	moveCover(window, calibrationCommand(), domain.PriorityManual)
+}
 
-		wayToGo := 100 - value
-		a := float64(wayToGo) * factor
-		b := a - float64(wayToGo)
+// resetManualCommand drops the manual override and returns the window to automation.
+func resetManualCommand(window *domain.StateWindow) {
+	common.LogDebug(fmt.Sprintf("Resetting manual value of window %s", window.Id))
+	window.ManualValue.UpdateState(String(""))
+	clearManualTilt(window)
+	recalculateWindow(window)
+}
 
-		valueToGo = int(math.Round(float64(value) + b))
+func stopCommand(window *domain.StateWindow) {
+	manualCoverCommand(window, "STOP")
+}
 
-		newState = CoverStatePosition{
-			Position: Int(valueToGo),
-		}
+// resyncCommand asks zigbee2mqtt to read the state of the output cover from the device.
+func resyncCommand(window *domain.StateWindow) {
+	for _, cover := range window.Config.CoverOutputs() {
+		common.LogDebug(fmt.Sprintf("Requesting state of output cover %s", cover.StateTopic))
+		token := state.Mqtt.Publish(cover.StateTopic+"/get", 0, false, `{"state":"","position":""}`)
+		token.Wait()
+	}
+}
 
-		j, _ := json.Marshal(newState)
-		newStateString = string(j)
-	} else {
-		newState = CoverStatePosition{
-			Position: Int(value),
-		}
-		j, _ := json.Marshal(newState)
-		newStateString = string(j)
+func recalculateAll() {
+	common.LogDebug("Recalculating all windows")
+	for _, w := range state.Windows {
+		window := w
+		window.Dispatch(func() {
+			calculateWindowValue(window)
+			recalculateWindow(window)
+		})
 	}
+}
 
-	if currentPosition == valueToGo {
-		common.LogDebug(fmt.Sprintf("Skipping main cover update %s, new value %d equals current position %d", window.OutputCover.GetUniqueId(), value, currentPosition))
-		return
+// calibrationCommand returns the command opening the output cover completely. The calibration time is reset right
+// before it is sent, see calibrationWrite.
+func calibrationCommand() string {
+	s := CoverStateOnly{
+		State: String("OPEN"),
 	}
-	currentCalibrating, e := strconv.Atoi(*window.Calibrating.State)
-	if e != nil || currentCalibrating == 1 && valueToGo != 100 {
-		common.LogDebug(fmt.Sprintf("Skipping main cover update %s, cover currently in calibration", window.OutputCover.GetUniqueId()))
-		return
+	j, _ := json.Marshal(s)
+	return string(j)
+}
+
+// calibrationWrite returns the function the scheduler sends the calibration of the window with. It resets the
+// calibration time of the output covers, so they run until fully open, and opens them calibrationDelay later, tracked
+// by ack. Once the calibration time is reset, the covers are opened in any case, otherwise their position would be
+// lost.
+func calibrationWrite(window *domain.StateWindow, ack *domain.CommandAck) func() {
+	configs := window.Config.CoverOutputs()
+	covers := window.OutputCovers
+	open := func() {
+		for _, cover := range covers {
+			cover.WriteCommand(String(calibrationCommand()))
+		}
+		window.Calibrating.UpdateState(String("1"))
+		if ack != nil {
+			armAck(window, ack)
+		}
 	}
+	return func() {
+		for _, cover := range configs {
+			common.LogDebug(fmt.Sprintf("Fixing calibration time to set value to 100 for window %s/%s (output cover: %s)", window.Id, window.Config.Id, cover.StateTopic))
 
-	common.LogDebug(fmt.Sprintf("Updating main cover %s=%d (%s, current=%d)", window.OutputCover.GetUniqueId(), value, newStateString, currentPosition))
+			// Only to reset CalibrationTime and thus setting the position to 0
+			token := state.Mqtt.Publish(cover.StateTopic+"/set/calibration_time", 0, false, strconv.Itoa(cover.TimeUp+10))
+			token.Wait()
+
+			token = state.Mqtt.Publish(cover.StateTopic+"/set/calibration_time", 0, false, strconv.Itoa(cover.TimeUp))
+			token.Wait()
+		}
 
-	window.OutputCover.WriteCommand(String(newStateString))
+		if calibrationDelay <= 0 {
+			onWindowLoop(window, open)
+			return
+		}
+		time.AfterFunc(calibrationDelay, func() {
+			window.Dispatch(open)
+		})
+	}
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"testing"
+)
+
+const testCoverTopic = "zigbee2mqtt/cover"
+const testOpenTopic = "zigbee2mqtt/open"
+const testTiltedTopic = "zigbee2mqtt/tilted"
+
+func testWindowConfig(id string) domain.CtrlConfigWindow {
+	return domain.CtrlConfigWindow{
+		Id:                     id,
+		WindowSensorStateTopic: testOpenTopic + "_" + id,
+		TiltedSensorStateTopic: testTiltedTopic + "_" + id,
+		OutputCoverStateTopic:  testCoverTopic + "_" + id,
+		OutputCoverTimeUp:      26,
+		OutputCoverTimeDown:    24,
+		OpenAndDrizzle:         15,
+		OpenAndStorm:           0,
+		TiltedAndDrizzle:       60,
+		TiltedAndStorm:         15,
+		TiltedAndClosed:        75,
+	}
+}
+
+// newTestState replaces the global state with one backed by an in-memory client. Entities are initialized but not
+// subscribed and no event loops are running, so handlers can be called directly.
+func newTestState(windows ...domain.CtrlConfigWindow) *domain.MemoryClient {
+	common.LogState.Debug = false
+	calibrationDelay = 0
+
+	client := domain.NewMemoryClient()
+	state = domain.State{
+		Mqtt: client,
+		Configuration: &domain.CtrlConfig{
+			NodeId:          "test",
+			ChannelPrefix:   "shutter_control",
+			DiscoverChannel: "homeassistant",
+			Windows:         windows,
+		},
+		Topics: make(map[string]*domain.StateWindow),
+		States: make(map[string]string),
+	}
+	newControllerEntities()
+	for i := range state.Configuration.Windows {
+		state.Windows = append(state.Windows, newStateWindow(&state.Configuration.Windows[i]))
+	}
+	return client
+}
+
+func contactPayload(closed bool) *string {
+	return String(fmt.Sprintf("{\"contact\":%t}", closed))
+}
+
+func coverPayload(position int) *string {
+	return String(fmt.Sprintf("{\"position\":%d,\"state\":\"OPEN\",\"moving\":\"STOP\"}", position))
+}
+
+// setContacts sets the contact sensors of the window, open takes precedence over tilted as on real windows.
+func setContacts(window *domain.StateWindow, open bool, tilted bool) {
+	window.WindowOpenInputSensor.State = contactPayload(!open)
+	window.WindowTiltedInputSensor.State = contactPayload(!open && !tilted)
+}
+
+func lastCommand(client *domain.MemoryClient, window *domain.StateWindow) string {
+	commands := client.PublishedTo(*window.OutputCover.CommandTopic)
+	if len(commands) == 0 {
+		return ""
+	}
+	return commands[len(commands)-1]
+}
+
+func TestCalculateWindowValue(t *testing.T) {
+	tests := []struct {
+		name           string
+		open           bool
+		tilted         bool
+		rain           string
+		scheduled      string
+		wantOpenValue  string
+		wantOpenState  string
+		wantRainValue  string
+		unknownContact bool
+	}{
+		{"closed", false, false, domain.RainNone, "30", "", "0", "", false},
+		{"closed drizzle", false, false, domain.RainDrizzle, "30", "", "0", "", false},
+		{"closed storm", false, false, domain.RainStorm, "30", "", "0", "", false},
+		{"tilted", false, true, domain.RainNone, "30", "75", "1", "", false},
+		{"tilted drizzle below threshold", false, true, domain.RainDrizzle, "30", "75", "1", "", false},
+		{"tilted drizzle above threshold", false, true, domain.RainDrizzle, "100", "", "1", "60", false},
+		{"tilted storm", false, true, domain.RainStorm, "30", "75", "1", "15", false},
+		{"open", true, false, domain.RainNone, "30", "100", "2", "", false},
+		{"open drizzle", true, false, domain.RainDrizzle, "30", "100", "2", "15", false},
+		{"open storm", true, false, domain.RainStorm, "30", "100", "2", "0", false},
+		{"open and tilted storm", true, true, domain.RainStorm, "30", "100", "2", "0", false},
+		{"open scheduled open", true, false, domain.RainNone, "100", "", "2", "", false},
+		{"unknown contacts", false, false, domain.RainStorm, "30", "", "0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			if tt.unknownContact {
+				window.WindowOpenInputSensor.State = nil
+				window.WindowTiltedInputSensor.State = nil
+			} else {
+				setContacts(window, tt.open, tt.tilted)
+			}
+			state.RainInput.UpdateState(String(tt.rain))
+			window.ScheduledValue.UpdateState(String(tt.scheduled))
+
+			calculateWindowValue(window)
+
+			if *window.WindowOpenValue.State != tt.wantOpenValue {
+				t.Errorf("window open value = %q, want %q", *window.WindowOpenValue.State, tt.wantOpenValue)
+			}
+			if *window.WindowOpenState.State != tt.wantOpenState {
+				t.Errorf("window open state = %q, want %q", *window.WindowOpenState.State, tt.wantOpenState)
+			}
+			if *window.RainValue.State != tt.wantRainValue {
+				t.Errorf("rain value = %q, want %q", *window.RainValue.State, tt.wantRainValue)
+			}
+		})
+	}
+}
+
+func TestRecalculateWindow(t *testing.T) {
+	tests := []struct {
+		name        string
+		automation  string
+		scheduled   string
+		windowOpen  string
+		rain        string
+		manual      string
+		current     int
+		calibrating string
+		wantOutput  string
+		wantCommand string
+		wantSkipped string
+	}{
+		{"scheduled", "ON", "50", "", "", "", 0, "0", "50", `{"position":50}`, ""},
+		{"window open fixes 100 to 99", "ON", "50", "100", "", "", 0, "0", "99", `{"position":99}`, ""},
+		{"rain overrides window open", "ON", "50", "75", "15", "", 0, "0", "15", `{"position":15}`, ""},
+		{"manual overrides rain", "ON", "50", "", "15", "40", 0, "0", "40", `{"position":40}`, ""},
+		{"equal position", "ON", "50", "", "", "", 50, "0", "50", "", "equal position"},
+		{"automation off without manual", "OFF", "50", "", "", "", 0, "0", "50", "", "no value"},
+		{"automation off manual down", "OFF", "50", "", "", "30", 73, "0", "30", `{"position":36}`, ""},
+		{"scheduled closed", "ON", "0", "", "", "", 73, "0", "0", `{"position":0}`, ""},
+		{"scheduled open calibrates", "ON", "100", "", "", "", 30, "0", "100", `{"state":"OPEN"}`, ""},
+		{"manual stop", "ON", "50", "", "", "-2", 30, "0", "-2", `{"state":"STOP"}`, ""},
+		{"calibration in progress", "ON", "50", "", "", "", 30, "1", "50", "", "calibration in progress"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			window.Automation.State = String(tt.automation)
+			window.ScheduledValue.State = String(tt.scheduled)
+			window.WindowOpenValue.State = String(tt.windowOpen)
+			window.RainValue.State = String(tt.rain)
+			window.ManualValue.State = String(tt.manual)
+			window.Calibrating.State = String(tt.calibrating)
+			window.OutputCover.State = coverPayload(tt.current)
+
+			recalculateWindow(window)
+
+			if *window.OutputValue.State != tt.wantOutput {
+				t.Errorf("output value = %q, want %q", *window.OutputValue.State, tt.wantOutput)
+			}
+			if command := lastCommand(client, window); command != tt.wantCommand {
+				t.Errorf("command = %q, want %q", command, tt.wantCommand)
+			}
+			decisions := window.Decisions.Entries()
+			if len(decisions) != 1 {
+				t.Fatalf("recorded %d decisions, want 1", len(decisions))
+			}
+			if decisions[0].Skipped != tt.wantSkipped {
+				t.Errorf("skipped = %q, want %q", decisions[0].Skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestUpdateCover(t *testing.T) {
+	tests := []struct {
+		name            string
+		value           int
+		current         int
+		calibrating     string
+		wantCommand     string
+		wantSkipped     string
+		wantCalibration []string
+	}{
+		{"up", 60, 30, "0", `{"position":60}`, "", nil},
+		{"down compensates slower travel", 50, 73, "0", `{"position":54}`, "", nil},
+		{"closed", 0, 73, "0", `{"position":0}`, "", nil},
+		{"open calibrates", 100, 30, "0", `{"state":"OPEN"}`, "", []string{"36", "26"}},
+		{"open at open", 100, 100, "0", "", "equal position", nil},
+		{"stop", -2, 30, "0", `{"state":"STOP"}`, "", nil},
+		{"no value", -1, 30, "0", "", "no value", nil},
+		{"calibrating", 60, 30, "1", "", "calibration in progress", nil},
+		{"calibrating open", 100, 30, "1", `{"state":"OPEN"}`, "", []string{"36", "26"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			window.Calibrating.State = String(tt.calibrating)
+			window.OutputCover.State = coverPayload(tt.current)
+
+			command, skipped := updateCover(window, tt.value, domain.PriorityNormal)
+
+			if command != tt.wantCommand {
+				t.Errorf("command = %q, want %q", command, tt.wantCommand)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("skipped = %q, want %q", skipped, tt.wantSkipped)
+			}
+			if published := lastCommand(client, window); published != tt.wantCommand {
+				t.Errorf("published command = %q, want %q", published, tt.wantCommand)
+			}
+			calibration := client.PublishedTo(window.Config.OutputCoverStateTopic + "/set/calibration_time")
+			if fmt.Sprint(calibration) != fmt.Sprint(tt.wantCalibration) {
+				t.Errorf("calibration times = %v, want %v", calibration, tt.wantCalibration)
+			}
+		})
+	}
+}
+
+// TestWindowPipeline runs all combinations of contacts, rain and manual input through the whole pipeline.
+func TestWindowPipeline(t *testing.T) {
+	tests := []struct {
+		open        bool
+		tilted      bool
+		rain        string
+		manual      string
+		wantCommand string
+	}{
+		{false, false, domain.RainNone, "", `{"position":50}`},
+		{false, false, domain.RainDrizzle, "", `{"position":50}`},
+		{false, false, domain.RainStorm, "", `{"position":50}`},
+		{false, true, domain.RainNone, "", `{"position":75}`},
+		{false, true, domain.RainDrizzle, "", `{"position":75}`},
+		{false, true, domain.RainStorm, "", `{"position":15}`},
+		{true, false, domain.RainNone, "", `{"position":99}`},
+		{true, false, domain.RainDrizzle, "", `{"position":15}`},
+		{true, false, domain.RainStorm, "", `{"position":0}`},
+		{false, false, domain.RainNone, "40", `{"position":40}`},
+		{false, false, domain.RainDrizzle, "40", `{"position":40}`},
+		{false, false, domain.RainStorm, "40", `{"position":40}`},
+		{false, true, domain.RainNone, "40", `{"position":40}`},
+		{false, true, domain.RainDrizzle, "40", `{"position":40}`},
+		{false, true, domain.RainStorm, "40", `{"position":40}`},
+		{true, false, domain.RainNone, "40", `{"position":40}`},
+		{true, false, domain.RainDrizzle, "40", `{"position":40}`},
+		{true, false, domain.RainStorm, "40", `{"position":40}`},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("open=%t tilted=%t rain=%s manual=%s", tt.open, tt.tilted, tt.rain, tt.manual)
+		t.Run(name, func(t *testing.T) {
+			client := newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			setContacts(window, tt.open, tt.tilted)
+			state.RainInput.UpdateState(String(tt.rain))
+			window.ScheduledValue.UpdateState(String("50"))
+			window.ManualValue.UpdateState(String(tt.manual))
+			window.Calibrating.UpdateState(String("0"))
+			window.OutputCover.State = coverPayload(10)
+
+			calculateWindowValue(window)
+			recalculateWindow(window)
+
+			if command := lastCommand(client, window); command != tt.wantCommand {
+				t.Errorf("command = %q, want %q", command, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func TestScheduledCoverCommand(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{"OPEN", "100"},
+		{"CLOSE", "0"},
+		{"40", "40"},
+		{`{"position": 60}`, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			client := startTestState(t, testWindowConfig("w01"))
+			window := state.Windows[0]
+			client.Inject(*window.ScheduledInputCover.CommandTopic, tt.payload)
+			waitIdle(client)
+			window.Sync(func() {
+				if *window.ScheduledValue.State != tt.want {
+					t.Errorf("scheduled value = %q, want %q", *window.ScheduledValue.State, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestContactInconsistency(t *testing.T) {
+	tests := []struct {
+		name             string
+		open             *string
+		tilted           *string
+		wantOpenState    string
+		wantInconsistent string
+	}{
+		{"closed", contactPayload(true), contactPayload(true), "0", "OFF"},
+		{"tilted", contactPayload(true), contactPayload(false), "1", "OFF"},
+		{"open", contactPayload(false), contactPayload(false), "2", "OFF"},
+		{"open without tilted", contactPayload(false), contactPayload(true), "2", "ON"},
+		{"no contact", String(`{"battery":100}`), contactPayload(false), "1", "ON"},
+		{"not reported yet", nil, contactPayload(false), "1", "OFF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			window.WindowOpenInputSensor.State = tt.open
+			window.WindowTiltedInputSensor.State = tt.tilted
+
+			calculateWindowValue(window)
+
+			if *window.WindowOpenState.State != tt.wantOpenState {
+				t.Errorf("window open state = %q, want %q", *window.WindowOpenState.State, tt.wantOpenState)
+			}
+			if *window.ContactInconsistent.State != tt.wantInconsistent {
+				t.Errorf("inconsistent = %q, want %q", *window.ContactInconsistent.State, tt.wantInconsistent)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"time"
+)
+
+const defaultOfflineAfter = 120 * time.Minute
+const defaultLowBattery = 20
+
+var sensorHealthTick = 1 * time.Minute
+
+var sensorHealth = struct {
+	done chan struct{}
+}{}
+
+// startSensorHealth checks periodically whether the contact sensors are still reporting.
+func startSensorHealth() {
+	switch state.Configuration.ContactSensors.FailSafe {
+	case "", "last", "open", "closed":
+	default:
+		common.LogWarning(fmt.Sprintf("Unknown contact sensor fail safe %s, keeping the last state", state.Configuration.ContactSensors.FailSafe))
+	}
+
+	sensorHealth.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(sensorHealthTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, w := range state.Windows {
+					window := w
+					window.Dispatch(func() {
+						checkSensorHealth(window, now)
+					})
+				}
+			case <-done:
+				return
+			}
+		}
+	}(sensorHealth.done)
+}
+
+func stopSensorHealth() {
+	if sensorHealth.done != nil {
+		close(sensorHealth.done)
+		sensorHealth.done = nil
+	}
+}
+
+// newContactHealthSensors creates the offline and low battery sensors of a contact sensor of a window.
+func newContactHealthSensors(device *domain.Device, name string) (offline *domain.BinarySensor, lowBattery *domain.BinarySensor) {
+	offline = &domain.BinarySensor{
+		Device:         device,
+		Name:           String(name + "_offline"),
+		AppState:       &state,
+		DeviceClass:    String("problem"),
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		State:          String("OFF"),
+	}
+	lowBattery = &domain.BinarySensor{
+		Device:         device,
+		Name:           String(name + "_low_battery"),
+		AppState:       &state,
+		DeviceClass:    String("battery"),
+		EntityCategory: &domain.EntityCategoryDiagnostic,
+		State:          String("OFF"),
+	}
+	return offline, lowBattery
+}
+
+// checkSensorHealth updates the offline and low battery sensors of the window, going offline or online again
+// recalculates the window with the fail safe contact.
+func checkSensorHealth(window *domain.StateWindow, now time.Time) {
+	changed := checkContactHealth(window.WindowOpenInputSensor, window.OpenSensorOffline, window.OpenSensorLowBattery, now)
+	changed = checkContactHealth(window.WindowTiltedInputSensor, window.TiltedSensorOffline, window.TiltedSensorLowBattery, now) || changed
+	if changed {
+		calculateWindowValue(window)
+		recalculateWindow(window)
+	}
+}
+
+// checkContactHealth updates the offline and low battery sensors of a contact sensor and returns whether it went
+// offline or online.
+func checkContactHealth(sensor *domain.BinarySensor, offline *domain.BinarySensor, lowBattery *domain.BinarySensor, now time.Time) bool {
+	if sensor == nil {
+		return false
+	}
+	config := state.Configuration.ContactSensors
+
+	offlineAfter := defaultOfflineAfter
+	if config.OfflineAfterMinutes > 0 {
+		offlineAfter = time.Duration(config.OfflineAfterMinutes) * time.Minute
+	}
+	offlineState := "OFF"
+	if now.Sub(sensor.LastSeen) > offlineAfter {
+		offlineState = "ON"
+	}
+	changed := false
+	if *offline.State != offlineState {
+		if offlineState == "ON" {
+			common.LogWarning(fmt.Sprintf("Contact sensor %s did not report since %s", *sensor.UniqueId, sensor.LastSeen.Format(time.RFC3339)))
+		} else {
+			common.LogDebug(fmt.Sprintf("Contact sensor %s is online again", *sensor.UniqueId))
+		}
+		offline.UpdateState(&offlineState)
+		changed = true
+	}
+
+	threshold := defaultLowBattery
+	if config.LowBattery > 0 {
+		threshold = config.LowBattery
+	}
+	lowBatteryState := "OFF"
+	if battery := getContactBattery(sensor); battery != nil && *battery < threshold {
+		lowBatteryState = "ON"
+	}
+	if *lowBattery.State != lowBatteryState {
+		if lowBatteryState == "ON" {
+			common.LogWarning(fmt.Sprintf("Battery of contact sensor %s is low", *sensor.UniqueId))
+		}
+		lowBattery.UpdateState(&lowBatteryState)
+	}
+	return changed
+}
+
+// getContactBattery returns the battery level reported by the contact sensor, nil if unknown.
+func getContactBattery(sensor *domain.BinarySensor) *int {
+	if sensor.State == nil {
+		return nil
+	}
+	var s domain.AqaraDoorSensorState
+	if err := json.Unmarshal([]byte(*sensor.State), &s); err != nil {
+		return nil
+	}
+	return s.Battery
+}
+
+// contactClosed returns whether the contact of the sensor is closed, while offline the configured fail safe contact.
+func contactClosed(sensor *domain.BinarySensor, offline *domain.BinarySensor) bool {
+	if sensor != nil && offline != nil && offline.State != nil && *offline.State == "ON" {
+		switch state.Configuration.ContactSensors.FailSafe {
+		case "open":
+			return false
+		case "closed":
+			return true
+		}
+	}
+	return getContactSensorValue(sensor)
+}
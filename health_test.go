@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSensorOffline(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	state.Configuration.ContactSensors.OfflineAfterMinutes = 10
+	state.Configuration.ContactSensors.FailSafe = "open"
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	waitIdle(client)
+
+	window.Sync(func() {
+		checkSensorHealth(window, time.Now().Add(5*time.Minute))
+		if *window.OpenSensorOffline.State != "OFF" {
+			t.Errorf("open sensor offline = %q within the timeout, want OFF", *window.OpenSensorOffline.State)
+		}
+		checkSensorHealth(window, time.Now().Add(15*time.Minute))
+		if *window.OpenSensorOffline.State != "ON" || *window.TiltedSensorOffline.State != "ON" {
+			t.Errorf("sensors offline = %q/%q after the timeout, want ON", *window.OpenSensorOffline.State, *window.TiltedSensorOffline.State)
+		}
+		if *window.WindowOpenState.State != "2" {
+			t.Errorf("window open state = %q with fail safe open, want 2", *window.WindowOpenState.State)
+		}
+	})
+
+	// A message brings the sensor online again
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OpenSensorOffline.State != "OFF" {
+			t.Errorf("open sensor offline = %q after a message, want OFF", *window.OpenSensorOffline.State)
+		}
+		// The tilted sensor is still silent, an open window is not worse than a tilted one
+		if *window.WindowOpenState.State != "1" {
+			t.Errorf("window open state = %q with a silent tilted sensor, want 1", *window.WindowOpenState.State)
+		}
+	})
+}
+
+func TestSensorOfflineLastState(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	waitIdle(client)
+
+	window.Sync(func() {
+		checkSensorHealth(window, time.Now().Add(defaultOfflineAfter+time.Minute))
+		if *window.OpenSensorOffline.State != "ON" {
+			t.Errorf("open sensor offline = %q after the default timeout, want ON", *window.OpenSensorOffline.State)
+		}
+		if *window.WindowOpenState.State != "0" {
+			t.Errorf("window open state = %q keeping the last state, want 0", *window.WindowOpenState.State)
+		}
+	})
+}
+
+func TestSensorLowBattery(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, `{"contact":true,"battery":50,"linkquality":120,"voltage":3000}`)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OpenSensorLowBattery.State != "OFF" {
+			t.Errorf("open sensor low battery = %q at 50%%, want OFF", *window.OpenSensorLowBattery.State)
+		}
+	})
+
+	client.Inject(window.Config.WindowSensorStateTopic, `{"contact":true,"battery":10,"linkquality":120,"voltage":2700}`)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OpenSensorLowBattery.State != "ON" {
+			t.Errorf("open sensor low battery = %q at 10%%, want ON", *window.OpenSensorLowBattery.State)
+		}
+		if *window.TiltedSensorLowBattery.State != "OFF" {
+			t.Errorf("tilted sensor low battery = %q without battery data, want OFF", *window.TiltedSensorLowBattery.State)
+		}
+	})
+	if len(client.PublishedTo(*window.OpenSensorLowBattery.StateTopic)) == 0 {
+		t.Errorf("low battery sensor not published")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+)
+
+// lockedOut reports whether the window is a door with lockout protection which is open, its cover must not move down.
+func lockedOut(window *domain.StateWindow) bool {
+	return window.Config.Lockout && !contactClosed(window.WindowOpenInputSensor, window.OpenSensorOffline)
+}
+
+// lockoutCover drops the commands queued, held back or retried for the output covers of an open door and stops them
+// when moving down. The target is applied by the recalculation once the door closes.
+func lockoutCover(window *domain.StateWindow) {
+	cancelOutputCommands(window)
+	if outputsMovingDown(window) {
+		common.LogWarning(fmt.Sprintf("Stopping output cover of window %s moving down while the door is open", window.Id))
+		moveCover(window, stopCoverCommand, domain.PriorityRain)
+		return
+	}
+	state.Commands.Cancel(window.OutputCover)
+	clearAck(window)
+	cancelMove(window)
+}
+
+// coverMoving returns the direction the cover reports to move in, empty if unknown.
+func coverMoving(cover *domain.Cover) string {
+	if cover == nil || cover.State == nil {
+		return ""
+	}
+	var s domain.CoverState
+	if err := json.Unmarshal([]byte(*cover.State), &s); err != nil || s.Moving == nil {
+		return ""
+	}
+	return *s.Moving
+}
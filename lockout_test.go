@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestLockout(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Lockout = true
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(60))
+	waitIdle(client)
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+	client.ClearPublished()
+
+	client.Inject(*window.ManualInputCover.CommandTopic, "0")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != "" {
+		t.Errorf("command = %q while the door is open, want none", command)
+	}
+
+	// Moving up is still allowed
+	client.Inject(*window.ManualInputCover.CommandTopic, "80")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":80}` {
+		t.Errorf("command = %q moving up while the door is open, want position 80", command)
+	}
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(80))
+	client.Inject(*window.ManualInputCover.CommandTopic, "0")
+	waitIdle(client)
+	client.ClearPublished()
+
+	// The pending target is applied once the door closes
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":0}` {
+		t.Errorf("command = %q after the door closed, want position 0", command)
+	}
+}
+
+func TestLockoutStopsMovingCover(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Lockout = true
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(60))
+	waitIdle(client)
+	client.Inject(*window.ManualInputCover.CommandTopic, "0")
+	client.Inject(window.Config.OutputCoverStateTopic, `{"position":50,"state":"OPEN","moving":"DOWN"}`)
+	waitIdle(client)
+	client.ClearPublished()
+
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	waitIdle(client)
+	if command := lastCommand(client, window); command != stopCoverCommand {
+		t.Errorf("command = %q opening the door of a cover moving down, want stop", command)
+	}
+}
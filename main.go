@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"os"
 	"os/signal"
@@ -12,16 +13,50 @@ import (
 var mqttClient mqtt.Client
 
 func main() {
+	simulate := flag.Bool("simulate", false, "simulate output covers and contact sensors, toggle sensors with 'open|tilt|close <window>' on stdin")
+	record := flag.String("record", "", "record all inbound messages of the entities to the given JSONL file, see replay")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			common.LogError(err.Error())
+		}
+		return
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	config := loadConfig()
 	loadState()
 
+	broker := startEmbeddedBroker(&config)
 	mqttClient = connect(config)
 	state.Configuration = &config
-	state.Mqtt = &mqttClient
+	state.Mqtt = mqttClient
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			common.LogError(err.Error())
+		}
+		defer f.Close()
+		state.Mqtt = newRecordingClient(mqttClient, f)
+	}
+	initAudit()
+	initDiscovery()
+	initScheduler()
+	if *simulate {
+		simulateTopics(state.Configuration)
+	}
 	initEntities()
+	if *simulate {
+		startSimulation()
+		go readSimulationCommands(os.Stdin)
+	}
+	cleanupDiscovery()
+	startVacation()
+	startSensorHealth()
+	startClimate()
 
 	//	mqtt.DEBUG = common.DebugLog
 	mqtt.WARN = common.WarnLog
@@ -46,9 +81,20 @@ func main() {
 	<-done
 
 	stateUpdateTicker.Stop()
+	stopDiscovery()
+	stopScheduler()
+	stopSimulation()
+	stopVacation()
+	stopSensorHealth()
+	stopClimate()
+	for _, w := range state.Windows {
+		w.Stop()
+	}
 	writeState()
+	closeAudit()
 	common.LogDebug("Shutter control stopped")
 	makeUnAvailable()
 	disconnect(mqttClient)
+	stopEmbeddedBroker(broker)
 	time.Sleep(1 * time.Second)
 }
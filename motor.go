@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"time"
+)
+
+// moveCover sends a command to the output cover of the window, protecting its motor. Commands following each other
+// within the debounce time are coalesced, the latest one is sent. A command reversing the direction of the motor is
+// held back until the motor kept its direction for the reversal dwell time. Stop commands are sent right away.
+func moveCover(window *domain.StateWindow, command string, priority int) {
+	holdMove(window, command, priority, nil)
+}
+
+// retryMove sends the command of ack again, protecting the motor like moveCover. The retry keeps tracking ack.
+func retryMove(window *domain.StateWindow, ack *domain.CommandAck) {
+	holdMove(window, ack.Command, ack.Priority, ack)
+}
+
+func holdMove(window *domain.StateWindow, command string, priority int, ack *domain.CommandAck) {
+	m := &window.Motor
+	target, ok := commandTarget(command)
+	if !ok {
+		cancelMove(window)
+		sendCoverCommand(window, command, priority)
+		return
+	}
+
+	m.Seq++
+	m.PendingCommand = command
+	m.PendingTarget = target
+	m.PendingPriority = priority
+	m.PendingAck = ack
+	m.Pending = true
+
+	config := state.Configuration.Motor
+	delay := time.Duration(config.DebounceMs) * time.Millisecond
+	if direction := moveDirection(window, target); direction != 0 && direction != m.Direction && !m.LastMove.IsZero() {
+		dwell := time.Duration(config.ReversalDwellMs)*time.Millisecond - time.Since(m.LastMove)
+		if dwell > delay {
+			common.LogDebug(fmt.Sprintf("Holding back reversal of window %s for %s", window.Id, dwell))
+			delay = dwell
+		}
+	}
+
+	if m.Timer != nil {
+		m.Timer.Stop()
+	}
+	if delay <= 0 {
+		flushMove(window)
+		return
+	}
+	seq := m.Seq
+	m.Timer = time.AfterFunc(delay, func() {
+		window.Dispatch(func() {
+			// A later command rearmed the timer after this one fired
+			if window.Motor.Seq == seq {
+				flushMove(window)
+			}
+		})
+	})
+}
+
+// cancelMove drops the command held back, e.g. when the cover already is at the position wanted.
+func cancelMove(window *domain.StateWindow) {
+	m := &window.Motor
+	if m.Timer != nil {
+		m.Timer.Stop()
+	}
+	m.Seq++
+	m.Pending = false
+}
+
+// flushMove sends the command held back and counts the movement against the daily budget.
+func flushMove(window *domain.StateWindow) {
+	m := &window.Motor
+	if !m.Pending {
+		return
+	}
+	m.Pending = false
+
+	if direction := moveDirection(window, m.PendingTarget); direction != 0 {
+		m.Direction = direction
+	}
+	m.LastMove = time.Now()
+	countMove(window, m.LastMove)
+	if m.PendingAck != nil && window.Ack == m.PendingAck {
+		scheduleCoverCommand(window, m.PendingCommand, m.PendingPriority, m.PendingAck)
+		return
+	}
+	sendCoverCommand(window, m.PendingCommand, m.PendingPriority)
+}
+
+// moveDirection returns 1 when moving up to target, -1 when moving down and 0 when already there.
+func moveDirection(window *domain.StateWindow, target int) int {
+	current := getCoverPosition(window.OutputCover)
+	if target > current {
+		return 1
+	} else if target < current {
+		return -1
+	}
+	return 0
+}
+
+// countMove raises the budget warning of the window once it moved more often today than the daily budget allows,
+// the warning is cleared with the first movement of the next day.
+func countMove(window *domain.StateWindow, now time.Time) {
+	m := &window.Motor
+	budget := state.Configuration.Motor.DailyBudget
+
+	day := now.Format("2006-01-02")
+	if m.Day != day {
+		m.Day = day
+		m.Moves = 0
+		if *window.MotorBudget.State == "ON" {
+			window.MotorBudget.UpdateState(String("OFF"))
+		}
+	}
+	m.Moves++
+
+	if budget > 0 && m.Moves > budget && *window.MotorBudget.State != "ON" {
+		common.LogWarning(fmt.Sprintf("Output cover of window %s moved %d times today, exceeding the budget of %d", window.Id, m.Moves, budget))
+		window.MotorBudget.UpdateState(String("ON"))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func TestMotorDebounce(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	state.Configuration.Motor = domain.CtrlConfigMotor{DebounceMs: 30}
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	waitIdle(client)
+	client.ClearPublished()
+
+	for _, p := range []string{"20", "40", "60"} {
+		client.Inject(*window.ManualInputCover.CommandTopic, p)
+	}
+	waitIdle(client)
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 0 {
+		t.Fatalf("sent %v within the debounce time", commands)
+	}
+
+	commands := waitPublished(client, *window.OutputCover.CommandTopic, 1)
+	time.Sleep(50 * time.Millisecond)
+	if commands = client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 1 || commands[0] != `{"position":60}` {
+		t.Errorf("sent %v, want only the latest position 60", commands)
+	}
+}
+
+func TestMotorReversalDwell(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	state.Configuration.Motor = domain.CtrlConfigMotor{ReversalDwellMs: 100}
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	waitIdle(client)
+	client.ClearPublished()
+
+	start := time.Now()
+	client.Inject(*window.ManualInputCover.CommandTopic, "60")
+	waitIdle(client)
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(30))
+	waitIdle(client)
+
+	// Same direction, sent right away
+	client.Inject(*window.ManualInputCover.CommandTopic, "70")
+	waitIdle(client)
+	// Reversal, held back
+	client.Inject(*window.ManualInputCover.CommandTopic, "0")
+	waitIdle(client)
+	if commands := client.PublishedTo(*window.OutputCover.CommandTopic); len(commands) != 2 {
+		t.Fatalf("sent %v, want the reversal to be held back", commands)
+	}
+
+	// Stopping is never held back
+	client.Inject(*window.ManualInputCover.CommandTopic, "STOP")
+	waitIdle(client)
+	client.Inject(*window.ManualInputCover.CommandTopic, "0")
+	commands := waitPublished(client, *window.OutputCover.CommandTopic, 4)
+	if len(commands) != 4 || commands[2] != `{"state":"STOP"}` || commands[3] != `{"position":0}` {
+		t.Fatalf("sent %v", commands)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("reversed after %s, want at least the dwell time", elapsed)
+	}
+}
+
+func TestMotorDailyBudget(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	state.Configuration.Motor = domain.CtrlConfigMotor{DailyBudget: 2}
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	waitIdle(client)
+	client.ClearPublished()
+
+	for i, p := range []string{"20", "30", "40"} {
+		client.Inject(*window.ManualInputCover.CommandTopic, p)
+		waitIdle(client)
+		want := "OFF"
+		if i == 2 {
+			want = "ON"
+		}
+		window.Sync(func() {
+			if *window.MotorBudget.State != want {
+				t.Errorf("budget exceeded = %q after %d moves, want %s", *window.MotorBudget.State, i+1, want)
+			}
+		})
+	}
+
+	// The next day starts with a new budget
+	window.Sync(func() {
+		countMove(window, time.Now().AddDate(0, 0, 1))
+		if *window.MotorBudget.State != "OFF" || window.Motor.Moves != 1 {
+			t.Errorf("budget exceeded = %q with %d moves on the next day", *window.MotorBudget.State, window.Motor.Moves)
+		}
+	})
+}
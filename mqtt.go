@@ -9,9 +9,24 @@ import (
 
 func connect(config domain.CtrlConfig) mqtt.Client {
 
+	client, err := newClient(config, config.NodeId)
+	if err != nil {
+		panic(err)
+	}
+	common.LogDebug(fmt.Sprintf("Connected to %s", config.MqttHost))
+	token := client.Subscribe(config.ChannelPrefix, 1, messagePubHandler)
+	token.Wait()
+
+	common.LogDebug(fmt.Sprintf("Subscribed to control topic %s", config.ChannelPrefix))
+
+	return client
+}
+
+// newClient connects to the configured broker with the given client id.
+func newClient(config domain.CtrlConfig, clientId string) (mqtt.Client, error) {
 	options := mqtt.NewClientOptions()
 	options.AddBroker(config.MqttHost)
-	options.SetClientID(config.NodeId)
+	options.SetClientID(clientId)
 	options.SetDefaultPublishHandler(messagePubHandler)
 	options.OnConnect = connectHandler
 	options.OnConnectionLost = connectionLostHandler
@@ -19,15 +34,9 @@ func connect(config domain.CtrlConfig) mqtt.Client {
 	client := mqtt.NewClient(options)
 	token := client.Connect()
 	if token.Wait() && token.Error() != nil {
-		panic(token.Error())
+		return nil, token.Error()
 	}
-	common.LogDebug(fmt.Sprintf("Connected to %s", config.MqttHost))
-	token = client.Subscribe(config.ChannelPrefix, 1, messagePubHandler)
-	token.Wait()
-
-	common.LogDebug(fmt.Sprintf("Subscribed to control topic %s", config.ChannelPrefix))
-
-	return client
+	return client, nil
 }
 
 func disconnect(client mqtt.Client) {
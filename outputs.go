@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"time"
+)
+
+// newOutputCover creates a further output cover of a window, moving together with its output cover.
+func newOutputCover(device *domain.Device, name string, config *domain.CtrlConfigCover) *domain.Cover {
+	return &domain.Cover{
+		Device:           device,
+		Name:             String(name),
+		AppState:         &state,
+		StateTopic:       &config.StateTopic,
+		CommandTopic:     String(config.StateTopic + "/set"),
+		StateUpdatedFunc: &outputCoverHandler,
+	}
+}
+
+// getWindowPosition returns the position of the output covers of the window, the average if there are several.
+func getWindowPosition(window *domain.StateWindow) int {
+	if len(window.OutputCovers) < 2 {
+		return getCoverPosition(window.OutputCover)
+	}
+	sum := 0
+	for _, cover := range window.OutputCovers {
+		sum += getCoverPosition(cover)
+	}
+	return int(math.Round(float64(sum) / float64(len(window.OutputCovers))))
+}
+
+// coverPositions returns the positions of the output covers of a window with several of them, nil otherwise.
+func coverPositions(window *domain.StateWindow) []int {
+	if len(window.OutputCovers) < 2 {
+		return nil
+	}
+	positions := make([]int, len(window.OutputCovers))
+	for i, cover := range window.OutputCovers {
+		positions[i] = getCoverPosition(cover)
+	}
+	return positions
+}
+
+// coverTarget returns the position to send an output cover to for value. The cover measures its position by the
+// time moving up, but moves down faster, so the target moving down is raised by the ratio of the calibration times.
+func coverTarget(config domain.CtrlConfigCover, value int, current int) int {
+	if value < current && value != 0 {
+		factor := float64(config.TimeUp) / float64(config.TimeDown)
+
+		wayToGo := 100 - value
+		a := float64(wayToGo) * factor
+		b := a - float64(wayToGo)
+
+		return int(math.Round(float64(value) + b))
+	}
+	return value
+}
+
+func positionCommand(position int, tilt *int) string {
+	j, _ := json.Marshal(CoverStatePosition{
+		Position: Int(position),
+		Tilt:     tilt,
+	})
+	return string(j)
+}
+
+// outputsReached reports whether all output covers of the window are at their target for value.
+func outputsReached(window *domain.StateWindow, value int) bool {
+	configs := window.Config.CoverOutputs()
+	for i, cover := range window.OutputCovers {
+		current := getCoverPosition(cover)
+		if current != coverTarget(configs[i], value, current) {
+			return false
+		}
+	}
+	return true
+}
+
+// outputsTilted reports whether all output covers of the window report tilt.
+func outputsTilted(window *domain.StateWindow, tilt int) bool {
+	for _, cover := range window.OutputCovers {
+		if getCoverTilt(cover) != tilt {
+			return false
+		}
+	}
+	return true
+}
+
+// outputsMovingDown reports whether any output cover of the window is moving down.
+func outputsMovingDown(window *domain.StateWindow) bool {
+	for _, cover := range window.OutputCovers {
+		if coverMoving(cover) == "DOWN" {
+			return true
+		}
+	}
+	return false
+}
+
+// outputCommands returns the commands moving each output cover of a window with several of them to value, nil
+// otherwise.
+func outputCommands(window *domain.StateWindow, value int, tilt *int) []string {
+	if len(window.OutputCovers) < 2 {
+		return nil
+	}
+	configs := window.Config.CoverOutputs()
+	commands := make([]string, len(window.OutputCovers))
+	for i, cover := range window.OutputCovers {
+		commands[i] = positionCommand(coverTarget(configs[i], value, getCoverPosition(cover)), tilt)
+	}
+	return commands
+}
+
+// coverCommands returns the command for each output cover of the window. Position commands were prepared for each
+// cover by updateCover, other commands are the same for all covers.
+func coverCommands(window *domain.StateWindow, command string) []string {
+	if len(window.CoverCommands) == len(window.OutputCovers) && window.CoverCommands[0] == command {
+		return window.CoverCommands
+	}
+	commands := make([]string, len(window.OutputCovers))
+	for i := range commands {
+		commands[i] = command
+	}
+	return commands
+}
+
+// coverTravelTime estimates the time an output cover needs from current to target.
+func coverTravelTime(config domain.CtrlConfigCover, current int, target int) time.Duration {
+	seconds := config.TimeDown
+	if target > current {
+		seconds = config.TimeUp
+	}
+	way := math.Abs(float64(target-current)) / 100
+	return time.Duration(way * float64(seconds) * float64(time.Second))
+}
+
+// syncDelays returns how long to hold back the command of each output cover, so all covers finish at the same time
+// as the slowest one.
+func syncDelays(window *domain.StateWindow, commands []string) []time.Duration {
+	configs := window.Config.CoverOutputs()
+	travel := make([]time.Duration, len(commands))
+	var slowest time.Duration
+	for i, command := range commands {
+		if target, ok := commandTarget(command); ok {
+			travel[i] = coverTravelTime(configs[i], getCoverPosition(window.OutputCovers[i]), target)
+		}
+		if travel[i] > slowest {
+			slowest = travel[i]
+		}
+	}
+	delays := make([]time.Duration, len(commands))
+	for i := range commands {
+		if _, ok := commandTarget(commands[i]); ok {
+			delays[i] = slowest - travel[i]
+		}
+	}
+	return delays
+}
+
+// writeOutputCommands returns a function sending command to all output covers of the window, held back so they
+// finish together. Held back commands are dropped once a newer command for the window is scheduled.
+func writeOutputCommands(window *domain.StateWindow, command string) func() {
+	commands := coverCommands(window, command)
+	delays := syncDelays(window, commands)
+	window.OutputSeq++
+	seq := window.OutputSeq
+
+	return func() {
+		for i := range commands {
+			cover := window.OutputCovers[i]
+			c := commands[i]
+			if delays[i] <= 0 {
+				cover.WriteCommand(&c)
+				continue
+			}
+			common.LogDebug(fmt.Sprintf("Holding back %s of output cover %s for %s", c, *cover.UniqueId, delays[i]))
+			time.AfterFunc(delays[i], func() {
+				window.Dispatch(func() {
+					if window.OutputSeq == seq {
+						cover.WriteCommand(&c)
+					}
+				})
+			})
+		}
+	}
+}
+
+// cancelOutputCommands drops the commands held back for the output covers of the window.
+func cancelOutputCommands(window *domain.StateWindow) {
+	window.OutputSeq++
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func testMultiCoverConfig(id string, timeUp int, timeDown int) domain.CtrlConfigWindow {
+	config := testWindowConfig(id)
+	config.OutputCovers = []domain.CtrlConfigCover{{
+		StateTopic: config.OutputCoverStateTopic + "_2",
+		TimeUp:     timeUp,
+		TimeDown:   timeDown,
+	}}
+	return config
+}
+
+func TestMultipleOutputCovers(t *testing.T) {
+	client := startTestState(t, testMultiCoverConfig("w01", 26, 24))
+	window := state.Windows[0]
+	second := window.Config.OutputCovers[0].StateTopic
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(40))
+	client.Inject(second, *coverPayload(60))
+	waitIdle(client)
+
+	window.Sync(func() {
+		if position := getWindowPosition(window); position != 50 {
+			t.Errorf("window position = %d, want the average 50", position)
+		}
+	})
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(50))
+	client.Inject(second, *coverPayload(50))
+	waitIdle(client)
+	client.ClearPublished()
+
+	client.Inject(*window.CalibrateButton.CommandTopic, "PRESS")
+	waitIdle(client)
+	if commands := client.PublishedTo(second + "/set"); len(commands) != 1 || commands[0] != `{"state":"OPEN"}` {
+		t.Errorf("second cover got %v, want to be calibrated along", commands)
+	}
+	if len(client.PublishedTo(second+"/set/calibration_time")) != 2 {
+		t.Errorf("calibration time of the second cover not reset")
+	}
+
+	// Calibration is done once both covers are fully open
+	client.Inject(window.Config.OutputCoverStateTopic, `{"position":100,"state":"OPEN","moving":"UP"}`)
+	client.Inject(window.Config.OutputCoverStateTopic, `{"position":100,"state":"OPEN","moving":"STOP"}`)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.Calibrating.State != "1" {
+			t.Errorf("calibrating = %q with one cover open, want 1", *window.Calibrating.State)
+		}
+	})
+	client.Inject(second, `{"position":100,"state":"OPEN","moving":"UP"}`)
+	client.Inject(second, `{"position":100,"state":"OPEN","moving":"STOP"}`)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.Calibrating.State != "0" {
+			t.Errorf("calibrating = %q with both covers open, want 0", *window.Calibrating.State)
+		}
+	})
+	client.ClearPublished()
+
+	// Same speed, both covers are sent to their own target right away
+	client.Inject(*window.ManualInputCover.CommandTopic, "50")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":54}` {
+		t.Errorf("command = %q, want position 54", command)
+	}
+	if commands := client.PublishedTo(second + "/set"); len(commands) != 1 || commands[0] != `{"position":54}` {
+		t.Errorf("second cover got %v, want position 54", commands)
+	}
+	window.Sync(func() {
+		entries := window.Decisions.Entries()
+		decision := entries[len(entries)-1]
+		if len(decision.Positions) != 2 || decision.Positions[0] != 100 || decision.Positions[1] != 100 {
+			t.Errorf("decision positions = %v, want both covers", decision.Positions)
+		}
+	})
+}
+
+func TestSyncDelays(t *testing.T) {
+	newTestState(testMultiCoverConfig("w01", 26, 20))
+	window := state.Windows[0]
+	window.OutputCover.UpdateState(coverPayload(100))
+	window.OutputCovers[1].UpdateState(coverPayload(100))
+
+	commands := outputCommands(window, 50, nil)
+	if commands[0] != `{"position":54}` || commands[1] != `{"position":65}` {
+		t.Fatalf("commands = %v, want each cover to its own target", commands)
+	}
+	// 100 to 54 takes 11.04s, 100 to 65 takes 7s
+	delays := syncDelays(window, commands)
+	if delays[0] != 0 || delays[1] != 4040*time.Millisecond {
+		t.Errorf("delays = %v, want the faster cover held back by 4.04s", delays)
+	}
+	if delays := syncDelays(window, coverCommands(window, stopCoverCommand)); delays[0] != 0 || delays[1] != 0 {
+		t.Errorf("delays = %v for a stop, want none", delays)
+	}
+}
+
+func TestHeldBackCommands(t *testing.T) {
+	config := testMultiCoverConfig("w01", 1, 1)
+	config.OutputCoverTimeUp = 2
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	second := window.Config.OutputCovers[0].StateTopic
+
+	// Moving up half way takes 1s for the output cover and 0.5s for the second one
+	window.Sync(func() {
+		window.CoverCommands = outputCommands(window, 50, nil)
+		writeOutputCommands(window, window.CoverCommands[0])()
+	})
+	if commands := client.PublishedTo(second + "/set"); len(commands) != 0 {
+		t.Errorf("second cover got %v right away, want it held back", commands)
+	}
+	if commands := waitPublished(client, second+"/set", 1); len(commands) != 1 || commands[0] != `{"position":50}` {
+		t.Errorf("second cover got %v, want position 50 once held back", commands)
+	}
+
+	// A newer command drops the commands held back
+	client.ClearPublished()
+	window.Sync(func() {
+		window.CoverCommands = outputCommands(window, 50, nil)
+		writeOutputCommands(window, window.CoverCommands[0])()
+		cancelOutputCommands(window)
+	})
+	time.Sleep(700 * time.Millisecond)
+	waitIdle(client)
+	if commands := client.PublishedTo(second + "/set"); len(commands) != 0 {
+		t.Errorf("second cover got %v, want the held back command dropped", commands)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RecordedMessage is a single line of a recording.
+type RecordedMessage struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+}
+
+// recordEchoTimeout is how long a message published by the application is expected to come back from the broker.
+const recordEchoTimeout = 5 * time.Second
+
+// recordingClient records every inbound message of the subscriptions made through it. The echoes of messages the
+// application published itself, like the states of its own entities, are left out, they are reproduced by the
+// handlers on replay. Echoes are told apart by their payload, devices like the output cover publish to topics the
+// application publishes to as well.
+type recordingClient struct {
+	domain.MqttClient
+	mu      sync.Mutex
+	out     io.Writer
+	pending map[string][]recordedEcho
+}
+
+type recordedEcho struct {
+	payload string
+	at      time.Time
+}
+
+func newRecordingClient(client domain.MqttClient, out io.Writer) *recordingClient {
+	return &recordingClient{MqttClient: client, out: out, pending: make(map[string][]recordedEcho)}
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	now := time.Now()
+	c.pending[topic] = append(c.expire(topic, now), recordedEcho{payload: recordPayload(payload), at: now})
+	c.mu.Unlock()
+	return c.MqttClient.Publish(topic, qos, retained, payload)
+}
+
+func (c *recordingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.MqttClient.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		c.record(msg)
+		callback(client, msg)
+	})
+}
+
+func (c *recordingClient) record(msg mqtt.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	pending := c.expire(msg.Topic(), now)
+	for i, e := range pending {
+		if e.payload == string(msg.Payload()) {
+			c.pending[msg.Topic()] = append(pending[:i], pending[i+1:]...)
+			return
+		}
+	}
+	j, _ := json.Marshal(RecordedMessage{Time: now, Topic: msg.Topic(), Payload: string(msg.Payload())})
+	if _, err := c.out.Write(append(j, '\n')); err != nil {
+		common.LogWarning(fmt.Sprintf("Unable to record message: %s", err.Error()))
+	}
+}
+
+// expire drops the echoes of the topic which did not come back in time, e.g. of topics not subscribed.
+func (c *recordingClient) expire(topic string, now time.Time) []recordedEcho {
+	pending := c.pending[topic]
+	for len(pending) > 0 && now.Sub(pending[0].at) > recordEchoTimeout {
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(c.pending, topic)
+		return nil
+	}
+	c.pending[topic] = pending
+	return pending
+}
+
+func recordPayload(payload interface{}) string {
+	switch p := payload.(type) {
+	case string:
+		return p
+	case []byte:
+		return string(p)
+	default:
+		return fmt.Sprint(p)
+	}
+}
+
+// replayIdle waits until the in-memory client delivered all messages and all window event loops are idle.
+func replayIdle(client *domain.MemoryClient) {
+	for {
+		published := len(client.Published())
+		client.Flush()
+		for _, w := range state.Windows {
+			w.Sync(func() {})
+		}
+		client.Flush()
+		if len(client.Published()) == published {
+			return
+		}
+	}
+}
+
+// replayPoll is how often the commands caused by timers are collected while waiting for the next message,
+// replayTail how long they are collected after the last message.
+var replayPoll = 100 * time.Millisecond
+var replayTail = 5 * time.Second
+
+// replay feeds a recording through the handlers against an in-memory client and writes the commands sent to the
+// output covers as recorded messages, stamped with the time of the message causing them. Paced, the messages are
+// injected as far apart as they were recorded, so debouncing, retries, the scheduler and other timers behave like they
+// did. Commands sent later, by a timer or the scheduler, are stamped with the time passed since the last message.
+// Otherwise the commands are sent right away without the scheduler, so max_moving, spacing_ms and priorities do not apply.
+func replay(config domain.CtrlConfig, in io.Reader, out io.Writer, paced bool) error {
+	calibrationDelay = 0
+
+	client := domain.NewMemoryClient()
+	state = domain.State{
+		Mqtt:          client,
+		Configuration: &config,
+		States:        make(map[string]string),
+	}
+	if paced {
+		initScheduler()
+		defer stopScheduler()
+	}
+	initEntities()
+	defer func() {
+		for _, w := range state.Windows {
+			w.Stop()
+		}
+	}()
+
+	outputTopics := make(map[string]bool)
+	for _, w := range config.Windows {
+		for _, cover := range w.CoverOutputs() {
+			outputTopics[cover.StateTopic+"/set"] = true
+			outputTopics[cover.StateTopic+"/set/calibration_time"] = true
+		}
+	}
+
+	replayIdle(client)
+	handled := len(client.Published())
+	encoder := json.NewEncoder(out)
+	collect := func(stamp time.Time) {
+		published := client.Published()
+		for _, p := range published[handled:] {
+			if outputTopics[p.Topic] {
+				encoder.Encode(RecordedMessage{Time: stamp, Topic: p.Topic, Payload: p.Payload})
+			}
+		}
+		handled = len(published)
+	}
+	// wait collects the commands caused by timers until the recording continues after gap
+	var last time.Time
+	var injected time.Time
+	wait := func(gap time.Duration) {
+		for {
+			remaining := gap - time.Since(injected)
+			if remaining <= 0 {
+				return
+			}
+			if remaining > replayPoll {
+				remaining = replayPoll
+			}
+			time.Sleep(remaining)
+			replayIdle(client)
+			collect(last.Add(time.Since(injected)))
+		}
+	}
+
+	decoder := json.NewDecoder(in)
+	for {
+		var m RecordedMessage
+		err := decoder.Decode(&m)
+		if err == io.EOF {
+			if paced && !injected.IsZero() {
+				wait(replayTail)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if paced && !injected.IsZero() {
+			wait(m.Time.Sub(last))
+		}
+
+		last = m.Time
+		injected = time.Now()
+		client.Inject(m.Topic, m.Payload)
+		replayIdle(client)
+		collect(m.Time)
+	}
+}
+
+func replayCommand(args []string) error {
+	paced := false
+	if len(args) == 2 && args[0] == "--paced" {
+		paced = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: replay [--paced] <recording.jsonl>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	common.LogState.Debug = false
+	return replay(loadConfig(), f, os.Stdout, paced)
+}
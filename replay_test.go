@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"shutter_control/domain"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRecordingClient(t *testing.T) {
+	newTestState()
+	client := domain.NewMemoryClient()
+	var out bytes.Buffer
+	recorder := newRecordingClient(client, &out)
+
+	recorder.Subscribe("zigbee2mqtt/#", 0, func(client mqtt.Client, msg mqtt.Message) {}).Wait()
+	recorder.Publish("zigbee2mqtt/cover", 0, false, `{"position":40}`).Wait()
+	client.Inject("zigbee2mqtt/contact", `{"contact":true}`)
+	// The device publishes to the topic the application published to
+	client.Inject("zigbee2mqtt/cover", `{"position":30}`)
+	client.Flush()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("recorded %d messages, want 2 without the echo: %q", len(lines), out.String())
+	}
+	var device RecordedMessage
+	if err := json.Unmarshal([]byte(lines[1]), &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Topic != "zigbee2mqtt/cover" || device.Payload != `{"position":30}` {
+		t.Errorf("recorded %+v, want the state of the device", device)
+	}
+	var m RecordedMessage
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Topic != "zigbee2mqtt/contact" || m.Payload != `{"contact":true}` || m.Time.IsZero() {
+		t.Errorf("recorded %+v", m)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	newTestState(testWindowConfig("w01"))
+	config := *state.Configuration
+	window := state.Windows[0]
+	scheduled := *window.ScheduledInputCover.CommandTopic
+
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	messages := []RecordedMessage{
+		{start, window.Config.OutputCoverStateTopic, *coverPayload(10)},
+		{start.Add(1 * time.Second), window.Config.WindowSensorStateTopic, *contactPayload(true)},
+		{start.Add(2 * time.Second), window.Config.TiltedSensorStateTopic, *contactPayload(true)},
+		{start.Add(3 * time.Second), scheduled, `{"position": 50}`},
+		{start.Add(4 * time.Second), window.Config.TiltedSensorStateTopic, *contactPayload(false)},
+		{start.Add(5 * time.Second), window.Config.WindowSensorStateTopic, *contactPayload(false)},
+	}
+	var in bytes.Buffer
+	for _, m := range messages {
+		j, _ := json.Marshal(m)
+		in.Write(append(j, '\n'))
+	}
+
+	var out bytes.Buffer
+	if err := replay(config, &in, &out, false); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var m RecordedMessage
+		if err := decoder.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s", m.Time.Format("15:04:05"), m.Topic, m.Payload))
+	}
+	set := window.Config.OutputCoverStateTopic + "/set"
+	want := []string{
+		"08:00:01 " + set + ` {"position":0}`,
+		"08:00:02 " + set + ` {"position":0}`,
+		"08:00:03 " + set + ` {"position":50}`,
+		"08:00:04 " + set + ` {"position":75}`,
+		"08:00:05 " + set + ` {"position":99}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replayed commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestReplayPaced replays a recording in real time, the motor debounce coalesces only the commands recorded close to
+// each other.
+func TestReplayPaced(t *testing.T) {
+	newTestState(testWindowConfig("w01"))
+	config := *state.Configuration
+	config.Motor.DebounceMs = 100
+	tail := replayTail
+	replayTail = 300 * time.Millisecond
+	t.Cleanup(func() { replayTail = tail })
+	window := state.Windows[0]
+	scheduled := *window.ScheduledInputCover.CommandTopic
+
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	messages := []RecordedMessage{
+		{start, window.Config.OutputCoverStateTopic, *coverPayload(10)},
+		{start, window.Config.WindowSensorStateTopic, *contactPayload(true)},
+		{start, window.Config.TiltedSensorStateTopic, *contactPayload(true)},
+		{start, scheduled, `{"position": 50}`},
+		{start.Add(400 * time.Millisecond), scheduled, `{"position": 60}`},
+	}
+	var in bytes.Buffer
+	for _, m := range messages {
+		j, _ := json.Marshal(m)
+		in.Write(append(j, '\n'))
+	}
+
+	var out bytes.Buffer
+	if err := replay(config, &in, &out, true); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var m RecordedMessage
+		if err := decoder.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Time.Before(start.Add(100 * time.Millisecond)) {
+			t.Errorf("command %s stamped %s, want after the debounce", m.Payload, m.Time.Format("15:04:05.000"))
+		}
+		got = append(got, m.Payload)
+	}
+	want := []string{`{"position":50}`, `{"position":60}`}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("replayed commands %v, want %v", got, want)
+	}
+}
+
+// TestReplayScheduler limits the covers moving at the same time only when paced, replaying without waiting sends all
+// commands right away.
+func TestReplayScheduler(t *testing.T) {
+	newTestState(testWindowConfig("w01"), testWindowConfig("w02"))
+	config := *state.Configuration
+	config.Commands.MaxMoving = 1
+	tail := replayTail
+	replayTail = 300 * time.Millisecond
+	t.Cleanup(func() { replayTail = tail })
+	first, second := state.Windows[0], state.Windows[1]
+
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	stopped := start.Add(300 * time.Millisecond)
+	messages := []RecordedMessage{
+		{start, first.Config.OutputCoverStateTopic, *coverPayload(10)},
+		{start, second.Config.OutputCoverStateTopic, *coverPayload(10)},
+		{start, *state.RainInput.CommandTopic, domain.RainStorm},
+		{stopped, first.Config.OutputCoverStateTopic, `{"position":0,"moving":"STOP"}`},
+		{stopped, second.Config.OutputCoverStateTopic, `{"position":0,"moving":"STOP"}`},
+	}
+	recording := func() *bytes.Buffer {
+		var in bytes.Buffer
+		for _, m := range messages {
+			j, _ := json.Marshal(m)
+			in.Write(append(j, '\n'))
+		}
+		return &in
+	}
+	sent := func(paced bool) map[string]time.Time {
+		var out bytes.Buffer
+		if err := replay(config, recording(), &out, paced); err != nil {
+			t.Fatal(err)
+		}
+		times := make(map[string]time.Time)
+		decoder := json.NewDecoder(&out)
+		for decoder.More() {
+			var m RecordedMessage
+			if err := decoder.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := times[m.Topic]; !ok {
+				times[m.Topic] = m.Time
+			}
+		}
+		return times
+	}
+
+	firstSet, secondSet := first.Config.OutputCoverStateTopic+"/set", second.Config.OutputCoverStateTopic+"/set"
+	times := sent(false)
+	if !times[firstSet].Equal(start) || !times[secondSet].Equal(start) {
+		t.Errorf("commands sent at %v without pacing, want both at %s", times, start.Format("15:04:05.000"))
+	}
+	times = sent(true)
+	earlier, later := times[firstSet], times[secondSet]
+	if later.Before(earlier) {
+		earlier, later = later, earlier
+	}
+	if earlier.IsZero() || !earlier.Before(stopped) {
+		t.Errorf("first command sent at %s, want before %s", earlier.Format("15:04:05.000"), stopped.Format("15:04:05.000"))
+	}
+	if later.Before(stopped) {
+		t.Errorf("second command sent at %s while the other cover was moving, want from %s", later.Format("15:04:05.000"), stopped.Format("15:04:05.000"))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"time"
+)
+
+// moveTimeoutMargin is added to the calibration time of a cover, after which it is considered stopped even without
+// reporting it.
+const moveTimeoutMargin = 10 * time.Second
+
+// stopCoverCommand stops the output cover, it does not take a slot of the scheduler.
+const stopCoverCommand = `{"state":"STOP"}`
+
+// initScheduler starts the scheduler sending the commands of the output covers.
+func initScheduler() {
+	config := state.Configuration.Commands
+	state.Commands = domain.NewCommandScheduler(config.MaxMoving, time.Duration(config.SpacingMs)*time.Millisecond)
+	state.Commands.Start()
+}
+
+func stopScheduler() {
+	if state.Commands != nil {
+		state.Commands.Stop()
+	}
+}
+
+// sendCoverCommand schedules a command for the output cover of the window and tracks whether the cover reaches its
+// target.
+func sendCoverCommand(window *domain.StateWindow, command string, priority int) {
+	scheduleCoverCommand(window, command, priority, trackCommand(window, command, priority))
+}
+
+func scheduleCoverCommand(window *domain.StateWindow, command string, priority int, ack *domain.CommandAck) {
+	timeout := 0
+	for _, cover := range window.Config.CoverOutputs() {
+		if cover.TimeUp > timeout {
+			timeout = cover.TimeUp
+		}
+		if cover.TimeDown > timeout {
+			timeout = cover.TimeDown
+		}
+	}
+	// Commands held back for the output covers are replaced by this one
+	cancelOutputCommands(window)
+	// Several output covers of a window are written together, taking a single slot
+	var write func()
+	calibrating := command == calibrationCommand()
+	if calibrating {
+		write = calibrationWrite(window, ack)
+	} else if len(window.OutputCovers) > 1 {
+		write = writeOutputCommands(window, command)
+	}
+	domain.ScheduleCommand(&domain.ScheduledCommand{
+		Cover:    window.OutputCover,
+		Command:  command,
+		Priority: priority,
+		Moving:   command != stopCoverCommand,
+		Timeout:  time.Duration(timeout)*time.Second + moveTimeoutMargin,
+		Write:    write,
+		Sent: func() {
+			// The calibration arms the ack once the covers are opened
+			if ack != nil && !calibrating {
+				armAck(window, ack)
+			}
+		},
+	})
+}
+
+// onWindowLoop runs fn, called back by the scheduler, on the event loop of the window. Without a scheduler commands
+// are sent on the event loop already.
+func onWindowLoop(window *domain.StateWindow, fn func()) {
+	if state.Commands == nil {
+		fn()
+		return
+	}
+	window.Dispatch(fn)
+}
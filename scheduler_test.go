@@ -0,0 +1,140 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func TestCommandPriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		automation string
+		rain       int
+		manual     int
+		want       int
+	}{
+		{"scheduled", "ON", -1, -1, domain.PriorityNormal},
+		{"rain", "ON", 15, -1, domain.PriorityRain},
+		{"manual", "ON", 15, 30, domain.PriorityManual},
+		{"automation off", "OFF", 15, -1, domain.PriorityManual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestState(testWindowConfig("w01"))
+			window := state.Windows[0]
+			window.Automation.State = String(tt.automation)
+			if p := commandPriority(window, tt.rain, tt.manual); p != tt.want {
+				t.Errorf("priority = %d, want %d", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoppedCoverFreesSlot(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"), testWindowConfig("w02"))
+	state.Commands = domain.NewCommandScheduler(1, 0)
+	state.Commands.Start()
+	t.Cleanup(state.Commands.Stop)
+
+	client.Inject(*state.Windows[0].ManualInputCover.CommandTopic, "30")
+	client.Inject(*state.Windows[1].ManualInputCover.CommandTopic, "30")
+	waitScheduler(client)
+	var moving, waiting *domain.StateWindow
+	for _, w := range state.Windows {
+		if lastCommand(client, w) == "" {
+			waiting = w
+		} else {
+			moving = w
+		}
+	}
+	if moving == nil || waiting == nil {
+		t.Fatalf("both or no windows moving, want one")
+	}
+
+	// The output cover reports it stopped
+	client.Inject(moving.Config.OutputCoverStateTopic, `{"position":30,"moving":"STOP"}`)
+	waitScheduler(client)
+	if command := lastCommand(client, waiting); command != `{"position":30}` {
+		t.Errorf("command of the waiting window = %q once the other one stopped", command)
+	}
+}
+
+// waitScheduler waits until the windows are idle and the scheduler sent all commands it may send.
+func waitScheduler(client *domain.MemoryClient) {
+	for i := 0; i < 50; i++ {
+		waitIdle(client)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestCalibrationWaitsForSlot resets the calibration time only once the command to open is sent, until then the
+// window is not calibrating and follows newer targets.
+func TestCalibrationWaitsForSlot(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"), testWindowConfig("w02"))
+	state.Commands = domain.NewCommandScheduler(1, 0)
+	state.Commands.Start()
+	t.Cleanup(state.Commands.Stop)
+	first, second := state.Windows[0], state.Windows[1]
+	client.Inject(second.Config.OutputCoverStateTopic, *coverPayload(50))
+	waitIdle(client)
+
+	client.Inject(*first.ManualInputCover.CommandTopic, "30")
+	waitScheduler(client)
+	client.Inject(*second.CalibrateButton.CommandTopic, "PRESS")
+	waitScheduler(client)
+
+	calibrationTopic := second.Config.OutputCoverStateTopic + "/set/calibration_time"
+	if n := len(client.PublishedTo(calibrationTopic)); n != 0 {
+		t.Errorf("calibration time reset %d times while waiting for a slot", n)
+	}
+	second.Sync(func() {
+		if *second.Calibrating.State != "0" {
+			t.Errorf("calibrating = %q while waiting for a slot, want 0", *second.Calibrating.State)
+		}
+	})
+
+	client.Inject(first.Config.OutputCoverStateTopic, `{"position":30,"moving":"STOP"}`)
+	waitScheduler(client)
+	if n := len(client.PublishedTo(calibrationTopic)); n != 2 {
+		t.Errorf("calibration time reset %d times once sent, want 2", n)
+	}
+	if command := lastCommand(client, second); command != calibrationCommand() {
+		t.Errorf("command = %q, want %q", command, calibrationCommand())
+	}
+	second.Sync(func() {
+		if *second.Calibrating.State != "1" {
+			t.Errorf("calibrating = %q once sent, want 1", *second.Calibrating.State)
+		}
+	})
+}
+
+// TestCalibrationOpensAfterReset opens the output cover once its calibration time was reset, even if another command
+// followed within the calibration delay.
+func TestCalibrationOpensAfterReset(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	calibrationDelay = 30 * time.Millisecond
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(50))
+	waitIdle(client)
+
+	client.Inject(*window.CalibrateButton.CommandTopic, "PRESS")
+	client.Inject(*window.StopButton.CommandTopic, "PRESS")
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.Calibrating.State != "0" {
+			t.Errorf("calibrating = %q before opening, want 0", *window.Calibrating.State)
+		}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	waitIdle(client)
+	if command := lastCommand(client, window); command != calibrationCommand() {
+		t.Errorf("command = %q after the calibration delay, want %q", command, calibrationCommand())
+	}
+	window.Sync(func() {
+		if *window.Calibrating.State != "1" {
+			t.Errorf("calibrating = %q once opened, want 1", *window.Calibrating.State)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultEnterLux = 40000.0
+const defaultExitLux = 20000.0
+const defaultEnterDelay = 2 * time.Minute
+const defaultExitDelay = 10 * time.Minute
+const defaultShadingHold = 15 * time.Minute
+const defaultShadingPosition = 30
+
+func illuminanceSensor(window *domain.StateWindow) string {
+	if window.Config.IlluminanceSensor != "" {
+		return window.Config.IlluminanceSensor
+	}
+	return state.Configuration.Shading.IlluminanceSensor
+}
+
+// subscribeIlluminance subscribes the illuminance sensors, windows sharing a sensor share its subscription.
+func subscribeIlluminance() {
+	sensors := make(map[string][]*domain.StateWindow)
+	for _, w := range state.Windows {
+		if topic := illuminanceSensor(w); topic != "" {
+			sensors[topic] = append(sensors[topic], w)
+		}
+	}
+	for topic, windows := range sensors {
+		subscribeSensor(topic, illuminanceHandler(windows))
+	}
+}
+
+func illuminanceHandler(windows []*domain.StateWindow) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		illuminance, ok := parseIlluminance(string(msg.Payload()))
+		if !ok {
+			common.LogWarning(fmt.Sprintf("Ignoring illuminance %s of %s", string(msg.Payload()), msg.Topic()))
+			return
+		}
+		for _, w := range windows {
+			window := w
+			window.Dispatch(func() {
+				window.Shading.Illuminance = &illuminance
+				if calculateShadingValue(window, time.Now()) {
+					calculateWindowValue(window)
+					recalculateWindow(window)
+				}
+			})
+		}
+	}
+}
+
+// parseIlluminance accepts a plain number or the payload of a zigbee2mqtt sensor, {"illuminance_lux": 35000}.
+func parseIlluminance(payload string) (float64, bool) {
+	if strings.HasPrefix(payload, "{") {
+		var s struct {
+			Lux         *float64 `json:"illuminance_lux"`
+			Illuminance *float64 `json:"illuminance"`
+		}
+		if err := json.Unmarshal([]byte(payload), &s); err != nil {
+			return 0, false
+		}
+		if s.Lux != nil {
+			return *s.Lux, true
+		}
+		if s.Illuminance != nil {
+			return *s.Illuminance, true
+		}
+		return 0, false
+	}
+	lux, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	return lux, err == nil
+}
+
+func shadingSeconds(value *int, def time.Duration) time.Duration {
+	if value == nil {
+		return def
+	}
+	return time.Duration(*value) * time.Second
+}
+
+// calculateShadingValue runs the hysteresis of the shading layer and returns whether its value changed. Shading starts
+// once the illuminance stayed above the enter threshold for the enter delay and ends once it stayed below the exit
+// threshold for the exit delay, so passing clouds do not move the covers. A timer decides again once the delay passed.
+func calculateShadingValue(window *domain.StateWindow, now time.Time) bool {
+	s := &window.Shading
+	config := state.Configuration.Shading
+	enterLux, exitLux := defaultEnterLux, defaultExitLux
+	if config.EnterLux != nil {
+		enterLux = *config.EnterLux
+	}
+	if config.ExitLux != nil {
+		exitLux = *config.ExitLux
+	}
+
+	// The shading value is persisted, after a restart shading is active until the exit delay ended it
+	if !s.Active && *window.ShadingValue.State != "" {
+		s.Active = true
+	}
+	wanted := false
+	if s.Illuminance != nil && sunOnWindow(window, now) {
+		if s.Active {
+			wanted = *s.Illuminance >= exitLux
+		} else {
+			wanted = *s.Illuminance >= enterLux
+		}
+	}
+	if wanted == s.Active {
+		s.Crossed = time.Time{}
+		stopShadingTimer(window)
+		return false
+	}
+
+	if s.Crossed.IsZero() {
+		s.Crossed = now
+	}
+	delay := shadingSeconds(config.EnterDelaySeconds, defaultEnterDelay)
+	if s.Active {
+		delay = shadingSeconds(config.ExitDelaySeconds, defaultExitDelay)
+	}
+	due := s.Crossed.Add(delay)
+	if hold := s.Since.Add(shadingSeconds(config.HoldSeconds, defaultShadingHold)); !s.Since.IsZero() && hold.After(due) {
+		due = hold
+	}
+	if now.Before(due) {
+		armShadingTimer(window, due.Sub(now))
+		return false
+	}
+
+	stopShadingTimer(window)
+	s.Active = wanted
+	s.Since = now
+	s.Crossed = time.Time{}
+	value, tilt := "", ""
+	if s.Active {
+		position := defaultShadingPosition
+		if config.Position != nil {
+			position = *config.Position
+		}
+		if window.Config.ShadingPosition != nil {
+			position = *window.Config.ShadingPosition
+		}
+		value = strconv.Itoa(position)
+		if config.Tilt != nil {
+			tilt = strconv.Itoa(*config.Tilt)
+		}
+	}
+	common.LogDebug(fmt.Sprintf("Shading of window %s=%s", window.Id, value))
+	window.ShadingValue.UpdateState(&value)
+	if window.ShadingTiltValue != nil {
+		window.ShadingTiltValue.UpdateState(&tilt)
+	}
+	return true
+}
+
+func armShadingTimer(window *domain.StateWindow, delay time.Duration) {
+	s := &window.Shading
+	stopShadingTimer(window)
+	seq := s.Seq
+	s.Timer = time.AfterFunc(delay, func() {
+		window.Dispatch(func() {
+			// A later illuminance rearmed or stopped the timer after this one fired
+			if window.Shading.Seq == seq {
+				updateClimate(window, time.Now())
+			}
+		})
+	})
+}
+
+func stopShadingTimer(window *domain.StateWindow) {
+	s := &window.Shading
+	if s.Timer != nil {
+		s.Timer.Stop()
+		s.Timer = nil
+	}
+	s.Seq++
+}
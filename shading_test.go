@@ -0,0 +1,115 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func TestParseIlluminance(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    float64
+		wantOk  bool
+	}{
+		{"35000", 35000, true},
+		{`{"illuminance_lux": 1200, "illuminance": 30792}`, 1200, true},
+		{`{"illuminance": 800}`, 800, true},
+		{`{"battery": 90}`, 0, false},
+		{"bright", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseIlluminance(tt.payload)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("parseIlluminance(%q) = %v, %t, want %v, %t", tt.payload, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestShadingHysteresis(t *testing.T) {
+	newTestState(testWindowConfig("w01"))
+	window := state.Windows[0]
+	t.Cleanup(func() { stopShadingTimer(window) })
+	start := time.Now()
+	lux := func(value float64, at time.Duration) bool {
+		window.Shading.Illuminance = &value
+		return calculateShadingValue(window, start.Add(at))
+	}
+
+	steps := []struct {
+		name    string
+		lux     float64
+		at      time.Duration
+		changed bool
+		want    string
+	}{
+		{"bright", 50000, 0, false, ""},
+		{"passing cloud", 10000, time.Minute, false, ""},
+		{"bright again", 50000, 2 * time.Minute, false, ""},
+		{"before the enter delay", 50000, 3 * time.Minute, false, ""},
+		{"after the enter delay", 50000, 4 * time.Minute, true, "30"},
+		{"between the thresholds", 30000, 5 * time.Minute, false, "30"},
+		{"dark", 10000, 6 * time.Minute, false, "30"},
+		{"after the exit delay within the hold time", 10000, 17 * time.Minute, false, "30"},
+		{"after the hold time", 10000, 19 * time.Minute, true, ""},
+	}
+	for _, step := range steps {
+		changed := lux(step.lux, step.at)
+		if changed != step.changed || *window.ShadingValue.State != step.want {
+			t.Errorf("%s: changed = %t, shading value = %q, want %t, %q", step.name, changed, *window.ShadingValue.State, step.changed, step.want)
+		}
+	}
+}
+
+func TestShadingLowersCover(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.IlluminanceSensor = "zigbee2mqtt/lux_south"
+	config.ShadingPosition = Int(40)
+	client := startTestState(t, config)
+	state.Configuration.Shading.EnterDelaySeconds = Int(0)
+	window := state.Windows[0]
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 100}`)
+	client.Inject("zigbee2mqtt/lux_south", `{"illuminance_lux": 60000}`)
+	waitIdle(client)
+
+	window.Sync(func() {
+		if *window.ShadingValue.State != "40" {
+			t.Errorf("shading value = %q, want 40", *window.ShadingValue.State)
+		}
+		if *window.OutputValue.State != "40" {
+			t.Errorf("output = %q while shading, want 40", *window.OutputValue.State)
+		}
+		stopShadingTimer(window)
+	})
+}
+
+func TestShadingRestored(t *testing.T) {
+	client := newTestState()
+	config := testWindowConfig("w01")
+	config.IlluminanceSensor = "zigbee2mqtt/lux_south"
+	state.Configuration.Windows = []domain.CtrlConfigWindow{config}
+	state.Configuration.Shading.ExitDelaySeconds = Int(0)
+	// Shading before the restart
+	state.States["test_w_01_shading_value"] = "30"
+	state.Windows = nil
+	initEntities()
+	window := state.Windows[0]
+	t.Cleanup(func() {
+		window.Sync(func() { stopShadingTimer(window) })
+		window.Stop()
+	})
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.ShadingValue.State != "30" {
+			t.Fatalf("shading value = %q after the restart, want the persisted 30", *window.ShadingValue.State)
+		}
+	})
+
+	client.Inject("zigbee2mqtt/lux_south", `{"illuminance_lux": 500}`)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.ShadingValue.State != "" {
+			t.Errorf("shading value = %q for a low illuminance, want none", *window.ShadingValue.State)
+		}
+	})
+}
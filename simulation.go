@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const simulationTick = 500 * time.Millisecond
+
+var simulation = struct {
+	Covers   map[string]*virtualCover
+	Contacts map[string]*virtualContact
+	done     chan struct{}
+}{}
+
+// virtualCover behaves like the Moes curtain switch, it moves at the calibrated speed and reports moving and
+// position on its state topic. Once tilted, it reports the tilt of its slats as well.
+type virtualCover struct {
+	mu              sync.Mutex
+	client          domain.MqttClient
+	topic           string
+	timeUp          int
+	timeDown        int
+	calibrationTime int
+	position        float64
+	target          float64
+	moving          string
+	tilt            *int
+}
+
+// virtualContact behaves like the Aqara door sensor, contact is true while the window is closed.
+type virtualContact struct {
+	mu      sync.Mutex
+	client  domain.MqttClient
+	topic   string
+	contact bool
+	entity  *domain.Switch
+}
+
+func newVirtualCover(client domain.MqttClient, config domain.CtrlConfigCover, position int) *virtualCover {
+	return &virtualCover{
+		client:          client,
+		topic:           config.StateTopic,
+		timeUp:          config.TimeUp,
+		timeDown:        config.TimeDown,
+		calibrationTime: config.TimeUp,
+		position:        float64(position),
+		target:          float64(position),
+		moving:          "STOP",
+	}
+}
+
+func (c *virtualCover) subscribe() {
+	c.client.Subscribe(c.topic+"/set", 0, func(client mqtt.Client, msg mqtt.Message) {
+		c.command(string(msg.Payload()))
+	}).Wait()
+	c.client.Subscribe(c.topic+"/set/calibration_time", 0, func(client mqtt.Client, msg mqtt.Message) {
+		t, err := strconv.Atoi(string(msg.Payload()))
+		if err == nil {
+			c.mu.Lock()
+			c.calibrationTime = t
+			c.mu.Unlock()
+		}
+	}).Wait()
+	c.publish()
+}
+
+func (c *virtualCover) command(payload string) {
+	var cmd domain.CoverState
+	json.Unmarshal([]byte(payload), &cmd)
+
+	c.mu.Lock()
+	if cmd.Position != nil {
+		c.target = math.Max(0, math.Min(100, float64(*cmd.Position)))
+	} else if cmd.State != nil && *cmd.State == "OPEN" {
+		c.target = 100
+	} else if cmd.State != nil && *cmd.State == "CLOSE" {
+		c.target = 0
+	} else if cmd.State != nil && *cmd.State == "STOP" {
+		c.target = c.position
+	}
+	if cmd.Tilt != nil {
+		c.tilt = Int(int(math.Max(0, math.Min(100, float64(*cmd.Tilt)))))
+	}
+	c.mu.Unlock()
+	common.LogDebug(fmt.Sprintf("Simulated cover %s received %s", c.topic, payload))
+
+	// The slats turn right away
+	if cmd.Tilt != nil {
+		c.publish()
+	}
+}
+
+// tick moves the cover for the elapsed time and publishes its state while moving and once stopped.
+func (c *virtualCover) tick(elapsed time.Duration) {
+	c.mu.Lock()
+	if c.position == c.target {
+		if c.moving == "STOP" {
+			c.mu.Unlock()
+			return
+		}
+		c.moving = "STOP"
+	} else if c.target > c.position {
+		c.moving = "UP"
+		c.position = math.Min(c.target, c.position+elapsed.Seconds()*100/float64(c.timeUp))
+	} else {
+		c.moving = "DOWN"
+		c.position = math.Max(c.target, c.position-elapsed.Seconds()*100/float64(c.timeDown))
+	}
+	c.mu.Unlock()
+	c.publish()
+}
+
+func (c *virtualCover) publish() {
+	c.mu.Lock()
+	position := int(math.Round(c.position))
+	s := "OPEN"
+	if position == 0 {
+		s = "CLOSE"
+	}
+	j, _ := json.Marshal(domain.CoverState{
+		CalibrationTime: Int(c.calibrationTime),
+		Position:        Int(position),
+		State:           String(s),
+		Moving:          String(c.moving),
+		Tilt:            c.tilt,
+	})
+	c.mu.Unlock()
+	c.client.Publish(c.topic, 0, true, string(j)).Wait()
+}
+
+func (c *virtualCover) run(done chan struct{}) {
+	ticker := time.NewTicker(simulationTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.tick(simulationTick)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *virtualContact) set(open bool) {
+	s.mu.Lock()
+	s.contact = !open
+	j, _ := json.Marshal(struct {
+		Contact bool `json:"contact"`
+		Battery int  `json:"battery"`
+	}{s.contact, 100})
+	s.mu.Unlock()
+	common.LogDebug(fmt.Sprintf("Simulated contact %s open=%t", s.topic, open))
+	s.client.Publish(s.topic, 0, true, string(j)).Wait()
+
+	if s.entity != nil {
+		if open {
+			s.entity.UpdateState(String("ON"))
+		} else {
+			s.entity.UpdateState(String("OFF"))
+		}
+	}
+}
+
+// newVirtualContact creates the contact sensor along with a switch to toggle it from Homeassistant.
+func newVirtualContact(device *domain.Device, name string, topic string) *virtualContact {
+	contact := &virtualContact{client: state.Mqtt, topic: topic, contact: true}
+	contact.entity = &domain.Switch{
+		Device:   device,
+		Name:     String(name),
+		AppState: &state,
+		State:    String("OFF"),
+		CommandFunc: func(client mqtt.Client, msg mqtt.Message) {
+			contact.set(string(msg.Payload()) == "ON")
+		},
+	}
+	contact.entity.Initialize()
+	return contact
+}
+
+// simulateTopics moves the topics of the output covers and contact sensors of all windows to
+// <id>/simulation/<topic>. The virtual devices publish retained states, they must never overwrite those of the real
+// devices. Must be called before the entities are initialized.
+func simulateTopics(config *domain.CtrlConfig) {
+	for i := range config.Windows {
+		w := &config.Windows[i]
+		w.OutputCoverStateTopic = simulationTopic(config, w.OutputCoverStateTopic)
+		for j := range w.OutputCovers {
+			w.OutputCovers[j].StateTopic = simulationTopic(config, w.OutputCovers[j].StateTopic)
+		}
+		w.WindowSensorStateTopic = simulationTopic(config, w.WindowSensorStateTopic)
+		w.TiltedSensorStateTopic = simulationTopic(config, w.TiltedSensorStateTopic)
+	}
+}
+
+func simulationTopic(config *domain.CtrlConfig, topic string) string {
+	if topic == "" {
+		return ""
+	}
+	return config.NodeId + "/simulation/" + topic
+}
+
+// startSimulation replaces the output covers and contact sensors of all windows with virtual devices.
+func startSimulation() {
+	simulation.Covers = make(map[string]*virtualCover)
+	simulation.Contacts = make(map[string]*virtualContact)
+	simulation.done = make(chan struct{})
+
+	device := domain.Device{
+		Identifiers:  state.Configuration.NodeId + "_simulation",
+		Manufacturer: domain.Manufacturer,
+		Model:        domain.SimulationName,
+		Name:         domain.InstanceName + "_simulation",
+		SwVersion:    domain.SoftwareVersion,
+		ViaDevice:    state.Configuration.NodeId,
+	}
+	for _, w := range state.Windows {
+		for i, config := range w.Config.CoverOutputs() {
+			var position int
+			w.Sync(func() {
+				position = getCoverPosition(w.OutputCovers[i])
+			})
+			cover := newVirtualCover(state.Mqtt, config, position)
+			cover.subscribe()
+			go cover.run(simulation.done)
+			// Further output covers of a window are numbered from 2
+			if i == 0 {
+				simulation.Covers[w.Id] = cover
+			} else {
+				simulation.Covers[fmt.Sprintf("%s/%d", w.Id, i+1)] = cover
+			}
+		}
+
+		if w.Config.WindowSensorStateTopic != "" {
+			contact := newVirtualContact(&device, w.Id+"_sim_window_open", w.Config.WindowSensorStateTopic)
+			contact.entity.Subscribe()
+			contact.set(false)
+			simulation.Contacts[w.Id+"/open"] = contact
+		}
+		if w.Config.TiltedSensorStateTopic != "" {
+			contact := newVirtualContact(&device, w.Id+"_sim_window_tilted", w.Config.TiltedSensorStateTopic)
+			contact.entity.Subscribe()
+			contact.set(false)
+			simulation.Contacts[w.Id+"/tilted"] = contact
+		}
+	}
+	common.LogDebug(fmt.Sprintf("Simulating %d covers and %d contact sensors", len(simulation.Covers), len(simulation.Contacts)))
+}
+
+func stopSimulation() {
+	if simulation.done != nil {
+		close(simulation.done)
+		simulation.done = nil
+	}
+}
+
+// simulationCommand toggles the virtual contact sensors: `open <window>`, `tilt <window>` or `close <window>`.
+func simulationCommand(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return fmt.Errorf("usage: open|tilt|close <window>")
+	}
+	open, hasOpen := simulation.Contacts[fields[1]+"/open"]
+	tilted, hasTilted := simulation.Contacts[fields[1]+"/tilted"]
+	if !hasOpen && !hasTilted {
+		return fmt.Errorf("no simulated contact sensors for window %s", fields[1])
+	}
+	switch fields[0] {
+	case "open":
+		if hasOpen {
+			open.set(true)
+		}
+		if hasTilted {
+			tilted.set(true)
+		}
+	case "tilt":
+		if hasOpen {
+			open.set(false)
+		}
+		if hasTilted {
+			tilted.set(true)
+		}
+	case "close":
+		if hasOpen {
+			open.set(false)
+		}
+		if hasTilted {
+			tilted.set(false)
+		}
+	default:
+		return fmt.Errorf("unknown command %s, usage: open|tilt|close <window>", fields[0])
+	}
+	return nil
+}
+
+// readSimulationCommands reads simulation commands line by line, e.g. from stdin.
+func readSimulationCommands(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		if err := simulationCommand(scanner.Text()); err != nil {
+			common.LogWarning(err.Error())
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func TestVirtualCoverMoves(t *testing.T) {
+	client := domain.NewMemoryClient()
+	w := testWindowConfig("w01")
+	w.OutputCoverTimeUp = 20
+	w.OutputCoverTimeDown = 10
+	cover := newVirtualCover(client, w.CoverOutputs()[0], 0)
+
+	cover.command(`{"position":50}`)
+	cover.tick(5 * time.Second)
+	cover.tick(10 * time.Second)
+	cover.tick(time.Second)
+	cover.command(`{"state":"CLOSE"}`)
+	cover.tick(2 * time.Second)
+	cover.command(`{"state":"STOP"}`)
+	cover.tick(time.Second)
+	cover.tick(time.Second)
+
+	want := []string{
+		`{"calibration_time":20,"position":25,"state":"OPEN","moving":"UP"}`,
+		`{"calibration_time":20,"position":50,"state":"OPEN","moving":"UP"}`,
+		`{"calibration_time":20,"position":50,"state":"OPEN","moving":"STOP"}`,
+		`{"calibration_time":20,"position":30,"state":"OPEN","moving":"DOWN"}`,
+		`{"calibration_time":20,"position":30,"state":"OPEN","moving":"STOP"}`,
+	}
+	got := client.PublishedTo(w.OutputCoverStateTopic)
+	if len(got) != len(want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("state[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestVirtualCoverTilts(t *testing.T) {
+	client := domain.NewMemoryClient()
+	w := testWindowConfig("w01")
+	w.OutputCoverTimeUp = 20
+	cover := newVirtualCover(client, w.CoverOutputs()[0], 50)
+
+	cover.command(`{"tilt":30}`)
+	cover.command(`{"position":60,"tilt":120}`)
+	cover.tick(2 * time.Second)
+
+	want := []string{
+		`{"calibration_time":20,"position":50,"state":"OPEN","moving":"STOP","tilt":30}`,
+		`{"calibration_time":20,"position":50,"state":"OPEN","moving":"STOP","tilt":100}`,
+		`{"calibration_time":20,"position":60,"state":"OPEN","moving":"UP","tilt":100}`,
+	}
+	got := client.PublishedTo(w.OutputCoverStateTopic)
+	if len(got) != len(want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("state[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+// TestSimulation drives the whole pipeline with virtual devices, including the calibration when opening fully.
+func TestSimulation(t *testing.T) {
+	config := &domain.CtrlConfig{NodeId: "test", Windows: []domain.CtrlConfigWindow{testWindowConfig("w01")}}
+	simulateTopics(config)
+	client := startTestState(t, config.Windows...)
+	startSimulation()
+	defer stopSimulation()
+	window := state.Windows[0]
+	cover := simulation.Covers["w01"]
+	waitIdle(client)
+
+	move := func() {
+		cover.tick(30 * time.Second)
+		waitIdle(client)
+		cover.tick(time.Second)
+		waitIdle(client)
+	}
+	position := func() (p int) {
+		window.Sync(func() {
+			p = getCoverPosition(window.OutputCover)
+		})
+		return p
+	}
+
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 50}`)
+	waitIdle(client)
+	move()
+	if p := position(); p != 50 {
+		t.Errorf("scheduled position = %d, want 50", p)
+	}
+
+	if err := simulationCommand("open w01"); err != nil {
+		t.Fatal(err)
+	}
+	waitIdle(client)
+	move()
+	if p := position(); p != 99 {
+		t.Errorf("position after opening the window = %d, want 99", p)
+	}
+	move()
+	if p := position(); p != 100 {
+		t.Errorf("position after calibration = %d, want 100", p)
+	}
+	window.Sync(func() {
+		if *window.Calibrating.State != "0" {
+			t.Errorf("calibrating = %s, want 0", *window.Calibrating.State)
+		}
+	})
+
+	if err := simulationCommand("slam w01"); err == nil {
+		t.Error("unknown simulation command accepted")
+	}
+
+	// The real devices are left alone
+	for _, topic := range []string{testCoverTopic + "_w01", testOpenTopic + "_w01", testTiltedTopic + "_w01"} {
+		if n := len(client.PublishedTo(topic)); n != 0 {
+			t.Errorf("published %d messages to the real device topic %s", n, topic)
+		}
+	}
+}
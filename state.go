@@ -35,9 +35,11 @@ func loadState() {
 
 func writeState() {
 	currentTime := time.Now()
-	state.States["time"] = fmt.Sprintf("%02d.%02d.%d %02d:%02d:%02d", currentTime.Day(), currentTime.Month(), currentTime.Year(), currentTime.Hour(), currentTime.Minute(), currentTime.Second())
+	state.SetState("time", fmt.Sprintf("%02d.%02d.%d %02d:%02d:%02d", currentTime.Day(), currentTime.Month(), currentTime.Year(), currentTime.Hour(), currentTime.Minute(), currentTime.Second()))
 
-	file, _ := json.MarshalIndent(state.States, "", " ")
+	persistDiscoveryTopics()
+
+	file, _ := json.MarshalIndent(state.CopyStates(), "", " ")
 
 	_ = ioutil.WriteFile("config/states.json", file, 0644)
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// newTiltSensor creates a sensor holding a tilt layer of a window with venetian blinds.
+func newTiltSensor(device *domain.Device, name string) *domain.Sensor {
+	return &domain.Sensor{
+		Device:            device,
+		Name:              String(name),
+		AppState:          &state,
+		EntityCategory:    &domain.EntityCategoryDiagnostic,
+		UnitOfMeasurement: &domain.UnitPercent,
+		StateClass:        &domain.StateClassMeasurement,
+		ValueTemplate:     &domain.ValueTemplatePosition,
+	}
+}
+
+// tiltSensors returns the tilt layers of the window, none for windows without venetian blinds.
+func tiltSensors(sw *domain.StateWindow) []*domain.Sensor {
+	if sw.OutputTiltValue == nil {
+		return []*domain.Sensor{}
+	}
+	return []*domain.Sensor{sw.ScheduledTiltValue, sw.ShadingTiltValue, sw.RainTiltValue, sw.ManualTiltValue, sw.OutputTiltValue}
+}
+
+var windowManualTilt mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	window := state.WindowForTopic(msg.Topic())
+	value := string(msg.Payload())
+	window.Dispatch(func() {
+		manualTiltCommand(window, value)
+	})
+}
+
+// manualTiltCommand sets the manual tilt of the window, it is kept until the automation takes over again like the
+// manual position.
+func manualTiltCommand(window *domain.StateWindow, value string) {
+	tilt, ok := parseTilt(value)
+	if !ok || window.ManualTiltValue == nil {
+		common.LogWarning(fmt.Sprintf("Ignoring manual tilt %s of window %s", value, window.Id))
+		return
+	}
+	window.ManualTiltValue.UpdateState(String(strconv.Itoa(tilt)))
+	recalculateWindow(window)
+}
+
+var windowScheduledTilt mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	window := state.WindowForTopic(msg.Topic())
+	value := string(msg.Payload())
+	window.Dispatch(func() {
+		scheduledTiltCommand(window, value)
+	})
+}
+
+// scheduledTiltCommand sets the tilt of the scheduled cover, applied once its state comes back like the position.
+func scheduledTiltCommand(window *domain.StateWindow, value string) {
+	tilt, ok := parseTilt(value)
+	if !ok {
+		common.LogWarning(fmt.Sprintf("Ignoring scheduled tilt %s of window %s", value, window.Id))
+		return
+	}
+	j, _ := json.Marshal(domain.CoverState{Tilt: Int(tilt)})
+	window.ScheduledInputCover.UpdateState(String(string(j)))
+}
+
+// parseTilt accepts a tilt in percent, as plain number or as {"tilt": n}.
+func parseTilt(value string) (int, bool) {
+	var tilt int
+	if strings.HasPrefix(value, "{") {
+		var s domain.CoverState
+		if err := json.Unmarshal([]byte(value), &s); err != nil || s.Tilt == nil {
+			return 0, false
+		}
+		tilt = *s.Tilt
+	} else {
+		t, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, false
+		}
+		tilt = t
+	}
+	return tilt, tilt >= 0 && tilt <= 100
+}
+
+// calculateRainTilt applies the configured rain tilt while the rain layer holds the cover of the window.
+func calculateRainTilt(window *domain.StateWindow) {
+	if window.RainTiltValue == nil {
+		return
+	}
+	if window.Config.RainTilt != nil && *window.RainValue.State != "" {
+		window.RainTiltValue.UpdateState(String(strconv.Itoa(*window.Config.RainTilt)))
+	} else {
+		window.RainTiltValue.UpdateState(String(""))
+	}
+}
+
+// clearManualTilt drops the manual tilt along with the manual position.
+func clearManualTilt(window *domain.StateWindow) {
+	if window.ManualTiltValue != nil {
+		window.ManualTiltValue.UpdateState(String(""))
+	}
+}
+
+// recalculateTilt picks the tilt of the highest layer set, scheduled < shading < rain < manual, and publishes it as
+// the tilt output of the window. Without automation only the manual tilt is applied.
+func recalculateTilt(window *domain.StateWindow) {
+	if window.OutputTiltValue == nil {
+		return
+	}
+	tilt := ""
+	layers := []*domain.Sensor{window.ScheduledTiltValue, window.ShadingTiltValue, window.RainTiltValue, window.ManualTiltValue}
+	if !automationEnabled(window) {
+		layers = []*domain.Sensor{window.ManualTiltValue}
+	}
+	for _, layer := range layers {
+		if layer.State != nil && *layer.State != "" {
+			tilt = *layer.State
+		}
+	}
+	window.OutputTiltValue.UpdateState(&tilt)
+}
+
+// tiltTarget returns the tilt output of the window, -1 if there is none.
+func tiltTarget(window *domain.StateWindow) int {
+	if window.OutputTiltValue == nil || window.OutputTiltValue.State == nil {
+		return -1
+	}
+	tilt, err := strconv.Atoi(*window.OutputTiltValue.State)
+	if err != nil {
+		return -1
+	}
+	return tilt
+}
+
+// getCoverTilt returns the tilt reported by the cover, -1 if unknown.
+func getCoverTilt(cover *domain.Cover) int {
+	if cover == nil || cover.State == nil {
+		return -1
+	}
+	var s domain.CoverState
+	if err := json.Unmarshal([]byte(*cover.State), &s); err != nil || s.Tilt == nil {
+		return -1
+	}
+	return *s.Tilt
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"shutter_control/domain"
+	"testing"
+)
+
+func TestTiltLayers(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Tilt = true
+	config.RainTilt = Int(20)
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, `{"position":50,"state":"OPEN","moving":"STOP","tilt":50}`)
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position":50}`)
+	waitIdle(client)
+	client.ClearPublished()
+
+	client.Inject(*window.ScheduledInputCover.TiltCommandTopic, "30")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"tilt":30}` {
+		t.Errorf("command = %q for a scheduled tilt, want tilt 30", command)
+	}
+
+	client.Inject(*window.ManualInputCover.TiltCommandTopic, "70")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"tilt":70}` {
+		t.Errorf("command = %q for a manual tilt, want tilt 70", command)
+	}
+
+	// Moving the cover keeps the tilt
+	client.Inject(*window.ManualInputCover.CommandTopic, "80")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":80,"tilt":70}` {
+		t.Errorf("command = %q for a manual position, want position 80 and tilt 70", command)
+	}
+
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(false))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(false))
+	rainCommand(domain.RainStorm)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.RainTiltValue.State != "20" {
+			t.Errorf("rain tilt = %q while raining, want 20", *window.RainTiltValue.State)
+		}
+		if *window.OutputTiltValue.State != "70" {
+			t.Errorf("tilt output = %q with a manual tilt, want 70", *window.OutputTiltValue.State)
+		}
+		resetManualCommand(window)
+		if *window.OutputTiltValue.State != "20" {
+			t.Errorf("tilt output = %q after resetting the manual tilt, want the rain tilt 20", *window.OutputTiltValue.State)
+		}
+	})
+	rainCommand(domain.RainNone)
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.OutputTiltValue.State != "30" {
+			t.Errorf("tilt output = %q after the rain, want the scheduled tilt 30", *window.OutputTiltValue.State)
+		}
+	})
+}
+
+func TestTiltWithoutAutomation(t *testing.T) {
+	config := testWindowConfig("w01")
+	config.Tilt = true
+	config.RainTilt = Int(20)
+	client := startTestState(t, config)
+	window := state.Windows[0]
+	client.Inject(window.Config.WindowSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.TiltedSensorStateTopic, *contactPayload(true))
+	client.Inject(window.Config.OutputCoverStateTopic, `{"position":50,"state":"OPEN","moving":"STOP","tilt":50}`)
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position":50}`)
+	waitIdle(client)
+	client.ClearPublished()
+	client.Inject(*window.ScheduledInputCover.TiltCommandTopic, "30")
+	client.Inject(*window.Automation.CommandTopic, "OFF")
+	waitIdle(client)
+	window.Sync(func() {
+		recalculateWindow(window)
+		if *window.OutputTiltValue.State != "" {
+			t.Errorf("tilt output = %q without automation, want none", *window.OutputTiltValue.State)
+		}
+	})
+
+	client.Inject(*window.ManualInputCover.TiltCommandTopic, "120")
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.ManualTiltValue.State != "" {
+			t.Errorf("manual tilt = %q for an invalid tilt, want none", *window.ManualTiltValue.State)
+		}
+	})
+}
+
+func TestNoTiltEntities(t *testing.T) {
+	startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	if len(tiltSensors(window)) != 0 || window.ManualInputCover.TiltCommandTopic != nil {
+		t.Errorf("tilt entities created for a window without tilt")
+	}
+}
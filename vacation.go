@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"shutter_control/common"
+	"shutter_control/domain"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var vacationTick = 1 * time.Minute
+var vacationRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// vacationMove is a planned move of a window in vacation mode.
+type vacationMove struct {
+	At       time.Time
+	Position int
+	done     bool
+}
+
+var vacation = struct {
+	mu    sync.Mutex
+	day   string
+	moves map[string][]*vacationMove
+	done  chan struct{}
+}{}
+
+func vacationEnabled() bool {
+	return state.Vacation != nil && state.Vacation.GetState() == "ON"
+}
+
+// startVacation checks for due vacation moves periodically, they are only applied while the vacation mode is on.
+func startVacation() {
+	vacation.done = make(chan struct{})
+	go func(done chan struct{}) {
+		runVacation(time.Now())
+		ticker := time.NewTicker(vacationTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				runVacation(now)
+			case <-done:
+				return
+			}
+		}
+	}(vacation.done)
+}
+
+func stopVacation() {
+	if vacation.done != nil {
+		close(vacation.done)
+		vacation.done = nil
+	}
+}
+
+// planVacation draws the moves of all windows for the day of now. Each window moves at its own time to its own
+// position, so the house looks occupied.
+func planVacation(now time.Time) map[string][]*vacationMove {
+	moves := make(map[string][]*vacationMove)
+	for _, p := range state.Configuration.Vacation.Periods {
+		from, errFrom := vacationTime(now, p.From)
+		to, errTo := vacationTime(now, p.To)
+		if errFrom != nil || errTo != nil || !to.After(from) || p.Min > p.Max {
+			common.LogWarning(fmt.Sprintf("Ignoring invalid vacation period %s-%s (%d-%d)", p.From, p.To, p.Min, p.Max))
+			continue
+		}
+		for _, w := range state.Windows {
+			moves[w.Id] = append(moves[w.Id], &vacationMove{
+				At:       from.Add(time.Duration(vacationRand.Int63n(int64(to.Sub(from))))),
+				Position: p.Min + vacationRand.Intn(p.Max-p.Min+1),
+			})
+		}
+	}
+	for _, m := range moves {
+		sort.Slice(m, func(i, j int) bool { return m[i].At.Before(m[j].At) })
+	}
+	return moves
+}
+
+// vacationTime returns the time of day `15:04` on the day of day.
+func vacationTime(day time.Time, clock string) (time.Time, error) {
+	t, err := time.ParseInLocation("15:04", clock, day.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location()), nil
+}
+
+// runVacation moves the windows whose planned time has come. Moves missed, e.g. when the vacation mode is turned on
+// during the day, are applied at once, the latest one wins.
+func runVacation(now time.Time) {
+	if !vacationEnabled() {
+		return
+	}
+
+	vacation.mu.Lock()
+	day := now.Format("2006-01-02")
+	if vacation.day != day {
+		vacation.day = day
+		vacation.moves = planVacation(now)
+		for id, moves := range vacation.moves {
+			for _, m := range moves {
+				common.LogDebug(fmt.Sprintf("Vacation move of window %s planned at %s to %d", id, m.At.Format("15:04"), m.Position))
+			}
+		}
+	}
+	due := make(map[string]int)
+	for id, moves := range vacation.moves {
+		for _, m := range moves {
+			if !m.done && !now.Before(m.At) {
+				m.done = true
+				due[id] = m.Position
+			}
+		}
+	}
+	vacation.mu.Unlock()
+
+	for _, w := range state.Windows {
+		if position, ok := due[w.Id]; ok {
+			window := w
+			window.Dispatch(func() {
+				applyVacation(window, strconv.Itoa(position))
+			})
+		}
+	}
+}
+
+func applyVacation(window *domain.StateWindow, position string) {
+	common.LogDebug(fmt.Sprintf("Vacation position of window %s set to %s", window.Id, position))
+	window.VacationValue.UpdateState(&position)
+	calculateWindowValue(window)
+	recalculateWindow(window)
+}
+
+// masterAutomationSwitch suspends the automation of all windows, the switches of the windows are kept.
+var masterAutomationSwitch mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	value := string(msg.Payload())
+	changed := state.Automation.GetState() != value
+	state.Automation.UpdateState(&value)
+	if changed {
+		common.LogDebug(fmt.Sprintf("Master automation %s, recalculating all windows", value))
+		recalculateAll()
+		for _, w := range state.Windows {
+			window := w
+			window.Dispatch(func() {
+				updateGroups(window)
+			})
+		}
+	}
+}
+
+// vacationSwitch plans the moves of the day when the vacation mode is turned on and returns to the scheduled
+// positions when turned off.
+var vacationSwitch mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	value := string(msg.Payload())
+	changed := state.Vacation.GetState() != value
+	state.Vacation.UpdateState(&value)
+	if !changed {
+		return
+	}
+
+	vacation.mu.Lock()
+	vacation.day = ""
+	vacation.moves = nil
+	vacation.mu.Unlock()
+
+	if value == "ON" {
+		common.LogDebug("Vacation mode on")
+		runVacation(time.Now())
+		return
+	}
+	common.LogDebug("Vacation mode off, returning to the scheduled positions")
+	for _, w := range state.Windows {
+		window := w
+		window.Dispatch(func() {
+			applyVacation(window, "")
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math/rand"
+	"shutter_control/domain"
+	"testing"
+	"time"
+)
+
+func TestMasterAutomation(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 50}`)
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":50}` {
+		t.Fatalf("command = %q, want position 50", command)
+	}
+
+	client.Inject(*state.Automation.CommandTopic, "OFF")
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 70}`)
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":50}` {
+		t.Errorf("command = %q while suspended, want no new command", command)
+	}
+	window.Sync(func() {
+		if *window.Automation.State != "ON" {
+			t.Errorf("window automation = %q, want ON to be kept", *window.Automation.State)
+		}
+		if d := window.Decisions.Entries(); len(d) == 0 || !d[len(d)-1].Suspended {
+			t.Errorf("last decision not marked as suspended")
+		}
+	})
+
+	client.Inject(*state.Automation.CommandTopic, "ON")
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":70}` {
+		t.Errorf("command = %q after resuming, want position 70", command)
+	}
+}
+
+func TestPlanVacation(t *testing.T) {
+	newTestState(testWindowConfig("w01"), testWindowConfig("w02"))
+	vacationRand = rand.New(rand.NewSource(1))
+	state.Configuration.Vacation.Periods = []domain.CtrlConfigVacationPeriod{
+		{From: "18:00", To: "19:30", Min: 10, Max: 40},
+		{From: "07:00", To: "08:00", Min: 60, Max: 100},
+		{From: "7:00", To: "06:00", Min: 0, Max: 100},
+		{From: "xx", To: "08:00", Min: 0, Max: 100},
+	}
+
+	day := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	moves := planVacation(day)
+	for _, id := range []string{"w01", "w02"} {
+		m := moves[id]
+		if len(m) != 2 {
+			t.Fatalf("window %s has %d moves, want 2", id, len(m))
+		}
+		if m[0].At.Before(day.Add(-5*time.Hour)) || !m[0].At.Before(day.Add(-4*time.Hour)) ||
+			m[0].Position < 60 || m[0].Position > 100 {
+			t.Errorf("window %s morning move = %v", id, m[0])
+		}
+		if m[1].At.Before(day.Add(6*time.Hour)) || !m[1].At.Before(day.Add(7*time.Hour+30*time.Minute)) ||
+			m[1].Position < 10 || m[1].Position > 40 {
+			t.Errorf("window %s evening move = %v", id, m[1])
+		}
+	}
+}
+
+func TestVacationMode(t *testing.T) {
+	client := startTestState(t, testWindowConfig("w01"))
+	window := state.Windows[0]
+	state.Configuration.Vacation.Periods = []domain.CtrlConfigVacationPeriod{
+		{From: "00:00", To: "00:01", Min: 30, Max: 30},
+	}
+	client.Inject(window.Config.OutputCoverStateTopic, *coverPayload(10))
+	client.Inject(*window.ScheduledInputCover.CommandTopic, `{"position": 50}`)
+	waitIdle(client)
+
+	// Moves are only applied while the vacation mode is on
+	now := time.Now()
+	runVacation(time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 0, 0, now.Location()))
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":50}` {
+		t.Fatalf("command = %q with vacation mode off, want position 50", command)
+	}
+
+	client.Inject(*state.Vacation.CommandTopic, "ON")
+	waitIdle(client)
+	runVacation(time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 0, 0, now.Location()))
+	waitIdle(client)
+	if command := lastCommand(client, window); command != `{"position":30}` {
+		t.Errorf("command = %q in vacation mode, want position 30", command)
+	}
+
+	client.Inject(*state.Vacation.CommandTopic, "OFF")
+	waitIdle(client)
+	window.Sync(func() {
+		if *window.VacationValue.State != "" {
+			t.Errorf("vacation value = %q after turning off, want empty", *window.VacationValue.State)
+		}
+	})
+	if command := lastCommand(client, window); command != `{"position":50}` {
+		t.Errorf("command = %q after vacation, want scheduled position 50", command)
+	}
+}